@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+//OverflowPolicy is what happens to results when a resultBuffer is full
+type OverflowPolicy string
+
+//Supported overflow policies
+const (
+	//OverflowDropOldest drops the oldest buffered result to make room
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	//OverflowDropNewest drops the new result
+	OverflowDropNewest OverflowPolicy = "drop-newest"
+	//OverflowSpool moves every buffered result to the Spool
+	OverflowSpool OverflowPolicy = "spool"
+)
+
+//resultBuffer is a bounded buffer of Pings and Events waiting to be written
+type resultBuffer struct {
+	pings  []*Ping
+	events []*Event
+
+	max      int
+	policy   OverflowPolicy
+	overflow func(pings []*Ping, events []*Event)
+
+	droppedPings  uint64
+	droppedEvents uint64
+
+	mu *sync.Mutex
+}
+
+//newResultBuffer returns a new resultBuffer that holds up to max Pings and max Events. With OverflowSpool, overflow
+//is called with the buffered results when the buffer is full
+func newResultBuffer(max int, policy OverflowPolicy, overflow func(pings []*Ping, events []*Event)) (*resultBuffer, error) {
+	if max < 1 {
+		return nil, fmt.Errorf("Invalid buffer size: %d", max)
+	}
+	switch policy {
+	case OverflowDropOldest, OverflowDropNewest:
+	case OverflowSpool:
+		if overflow == nil {
+			return nil, fmt.Errorf("Overflow policy %s requires a spool", policy)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid overflow policy: %s", policy)
+	}
+
+	return &resultBuffer{
+		pings:    make([]*Ping, 0),
+		events:   make([]*Event, 0),
+		max:      max,
+		policy:   policy,
+		overflow: overflow,
+		mu:       new(sync.Mutex),
+	}, nil
+}
+
+//Add buffers p and events, applying the overflow policy if the buffer is full
+func (b *resultBuffer) Add(p *Ping, events []*Event) {
+	var overflowPings []*Ping
+	var overflowEvents []*Event
+
+	b.mu.Lock()
+	if p != nil {
+		if len(b.pings) >= b.max {
+			switch b.policy {
+			case OverflowDropOldest:
+				b.pings[0] = nil
+				b.pings = b.pings[1:]
+				b.droppedPings++
+			case OverflowDropNewest:
+				b.droppedPings++
+				p = nil
+			case OverflowSpool:
+				overflowPings, b.pings = b.pings, make([]*Ping, 0)
+			}
+		}
+		if p != nil {
+			b.pings = append(b.pings, p)
+		}
+	}
+
+	for _, e := range events {
+		if len(b.events) >= b.max {
+			switch b.policy {
+			case OverflowDropOldest:
+				b.events[0] = nil
+				b.events = b.events[1:]
+				b.droppedEvents++
+			case OverflowDropNewest:
+				b.droppedEvents++
+				continue
+			case OverflowSpool:
+				overflowEvents = append(overflowEvents, b.events...)
+				b.events = make([]*Event, 0)
+			}
+		}
+		b.events = append(b.events, e)
+	}
+	b.mu.Unlock()
+
+	if len(overflowPings) > 0 || len(overflowEvents) > 0 {
+		b.overflow(overflowPings, overflowEvents)
+	}
+}
+
+//Take removes and returns up to n of the oldest Pings and Events
+func (b *resultBuffer) Take(n int) ([]*Ping, []*Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	np, ne := len(b.pings), len(b.events)
+	if np > n {
+		np = n
+	}
+	if ne > n {
+		ne = n
+	}
+
+	pings := make([]*Ping, np)
+	copy(pings, b.pings)
+	b.pings = append(make([]*Ping, 0, len(b.pings)-np), b.pings[np:]...)
+
+	events := make([]*Event, ne)
+	copy(events, b.events)
+	b.events = append(make([]*Event, 0, len(b.events)-ne), b.events[ne:]...)
+
+	return pings, events
+}
+
+//Len returns the number of buffered Pings and Events
+func (b *resultBuffer) Len() (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.pings), len(b.events)
+}
+
+//Dropped returns the number of Pings and Events dropped because the buffer was full
+func (b *resultBuffer) Dropped() (uint64, uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.droppedPings, b.droppedEvents
+}
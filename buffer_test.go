@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+//pingIDs returns the Sent field of each Ping, which tests use as an ID
+func pingIDs(pings []*Ping) string {
+	ids := make([]int, 0, len(pings))
+	for _, p := range pings {
+		ids = append(ids, p.Sent)
+	}
+	return fmt.Sprint(ids)
+}
+
+//eventIDs returns the Unix time of each Event, which tests use as an ID
+func eventIDs(events []*Event) string {
+	ids := make([]int64, 0, len(events))
+	for _, e := range events {
+		ids = append(ids, e.Time.Unix())
+	}
+	return fmt.Sprint(ids)
+}
+
+func TestNewResultBuffer(t *testing.T) {
+	overflow := func([]*Ping, []*Event) {}
+	tests := []struct {
+		max      int
+		policy   OverflowPolicy
+		overflow func([]*Ping, []*Event)
+		err      bool
+	}{
+		{1, OverflowDropOldest, nil, false},
+		{1, OverflowDropNewest, nil, false},
+		{1, OverflowSpool, overflow, false},
+		{1, OverflowSpool, nil, true},
+		{0, OverflowDropOldest, nil, true},
+		{1, OverflowPolicy("drop-all"), nil, true},
+	}
+	for _, test := range tests {
+		if _, err := newResultBuffer(test.max, test.policy, test.overflow); (err != nil) != test.err {
+			t.Errorf("%d, %s: err = %v, want error: %v", test.max, test.policy, err, test.err)
+		}
+	}
+}
+
+func TestResultBufferOverflow(t *testing.T) {
+	tests := []struct {
+		policy   OverflowPolicy
+		buffered string
+		dropped  uint64
+		spooled  string
+	}{
+		{OverflowDropOldest, "[3 4 5]", 2, "[]"},
+		{OverflowDropNewest, "[1 2 3]", 2, "[]"},
+		//the full buffer is spooled and the new result is kept
+		{OverflowSpool, "[4 5]", 0, "[1 2 3]"},
+	}
+
+	for _, test := range tests {
+		spooledPings, spooledEvents := make([]*Ping, 0), make([]*Event, 0)
+		b, err := newResultBuffer(3, test.policy, func(pings []*Ping, events []*Event) {
+			spooledPings = append(spooledPings, pings...)
+			spooledEvents = append(spooledEvents, events...)
+		})
+		if err != nil {
+			t.Fatalf("%s: Unable to create resultBuffer: %v", test.policy, err)
+		}
+
+		//Pings are added one at a time and Events all at once
+		events := make([]*Event, 0)
+		for i := 1; i <= 5; i++ {
+			b.Add(&Ping{Sent: i}, nil)
+			events = append(events, &Event{Time: time.Unix(int64(i), 0)})
+		}
+		b.Add(nil, events)
+
+		pings, events := b.Take(10)
+		if got := pingIDs(pings); got != test.buffered {
+			t.Errorf("%s: buffered Pings = %s, want %s", test.policy, got, test.buffered)
+		}
+		if got := eventIDs(events); got != test.buffered {
+			t.Errorf("%s: buffered Events = %s, want %s", test.policy, got, test.buffered)
+		}
+		if dp, de := b.Dropped(); dp != test.dropped || de != test.dropped {
+			t.Errorf("%s: dropped = %d Pings, %d Events, want %d", test.policy, dp, de, test.dropped)
+		}
+		if got := pingIDs(spooledPings); got != test.spooled {
+			t.Errorf("%s: spooled Pings = %s, want %s", test.policy, got, test.spooled)
+		}
+		if got := eventIDs(spooledEvents); got != test.spooled {
+			t.Errorf("%s: spooled Events = %s, want %s", test.policy, got, test.spooled)
+		}
+	}
+}
+
+func TestResultBufferTake(t *testing.T) {
+	b, err := newResultBuffer(10, OverflowDropOldest, nil)
+	if err != nil {
+		t.Fatalf("Unable to create resultBuffer: %v", err)
+	}
+	for i := 1; i <= 5; i++ {
+		b.Add(&Ping{Sent: i}, []*Event{{Time: time.Unix(int64(i), 0)}})
+	}
+
+	tests := []struct {
+		n     int
+		taken string
+		left  int
+	}{
+		{2, "[1 2]", 3},
+		{0, "[]", 3},
+		{10, "[3 4 5]", 0},
+		{1, "[]", 0},
+	}
+	for _, test := range tests {
+		pings, events := b.Take(test.n)
+		if got := pingIDs(pings); got != test.taken {
+			t.Errorf("Take(%d) Pings = %s, want %s", test.n, got, test.taken)
+		}
+		if got := eventIDs(events); got != test.taken {
+			t.Errorf("Take(%d) Events = %s, want %s", test.n, got, test.taken)
+		}
+		if np, ne := b.Len(); np != test.left || ne != test.left {
+			t.Errorf("Take(%d) left %d Pings, %d Events, want %d", test.n, np, ne, test.left)
+		}
+	}
+}
@@ -1,14 +1,73 @@
 package main
 
 type config struct {
-	DNSWorkers        int    `required:"true" default:"8"`
-	DNSLookupInterval int    `required:"true" default:"30"` // in minutes
-	PingWorkers       int    `required:"true" default:"16"`
-	PingBufferSize    int    `required:"true" default:"1024"`
-	PingInterval      int    `required:"true" default:"5"`    // in seconds
-	PingTimeout       int    `required:"true" default:"1000"` // in milliseconds
-	PurgeInterval     int    `required:"true" default:"60"`   // in minutes
-	PurgeOlderThan    int    `required:"true" default:"1440"` // in minutes
-	GraphQLEndpoint   string `required:"true"`
-	GraphQLAPISecret  string `required:"true"`
+	DNSWorkers            int    `required:"true" default:"8"`
+	DNSLookupInterval     int    `required:"true" default:"30"` // in minutes
+	DNSServers            string // comma-separated host[:port] list, empty to use the system resolver
+	DNSProtocol           string `required:"true" default:"udp"`  // udp or tcp
+	DNSTimeout            int    `required:"true" default:"5000"` // in milliseconds
+	PingWorkers           int    `required:"true" default:"16"`
+	PingBufferSize        int    `required:"true" default:"1024"`
+	PingInterval          int    `required:"true" default:"5"`    // in seconds
+	PingTimeout           int    `required:"true" default:"1000"` // in milliseconds
+	PingCount             int    `required:"true" default:"1"`
+	PingSpacing           int    `required:"true" default:"100"`  // in milliseconds
+	PingSocketMode        string `required:"true" default:"auto"` // auto, raw, or unprivileged
+	PingIdentifiers       int    `required:"true" default:"4"`
+	SweepRate             int    `required:"true" default:"100"`  // in probes per second
+	SweepMaxHosts         int    `required:"true" default:"4096"` // addresses per subnet
+	StateFailThreshold    int    `required:"true" default:"3"`
+	StateRecoverThreshold int    `required:"true" default:"2"`
+	StateDegradedLoss     int    `required:"true" default:"1"`   // in percent
+	StateDegradedRTT      int    `required:"true" default:"500"` // in milliseconds, 0 to disable
+	StateFlapWindow       int    `required:"true" default:"10"`  // in minutes
+	StateFlapCount        int    `required:"true" default:"5"`   // transitions within StateFlapWindow, 0 to disable
+	AlertLoss             int    `required:"true" default:"0"`   // in percent, 0 to disable
+	AlertRTT              int    `required:"true" default:"0"`   // in milliseconds, 0 to disable
+	AlertDedupWindow      int    `required:"true" default:"60"`  // in minutes
+	AlertRetries          int    `required:"true" default:"5"`
+	AlertUnreachable      bool   `required:"true" default:"false"`
+	AlertTemplate         string
+	Webhooks              []string // format:url, where format is json, slack, or teams
+	SMTPHost              string
+	SMTPPort              int `required:"true" default:"587"`
+	SMTPUsername          string
+	SMTPPassword          string
+	SMTPFrom              string
+	SMTPStartTLS          bool              `required:"true" default:"true"`
+	SMTPRecipients        map[string]string // device type:recipient;recipient, * for all device types
+	SMTPCriticalTypes     []string
+	SMTPDigestInterval    int            `required:"true" default:"15"`      // in minutes
+	HTTPAddr              string         `default:":8080"`                   // /metrics, /healthz, and /readyz, empty to disable
+	HealthTimeout         int            `required:"true" default:"5"`       // in minutes
+	Sinks                 []string       `required:"true" default:"graphql"` // graphql, postgres, influxdb, file, or prometheus
+	SinkBatchSizes        map[string]int // sink:batch size, overrides WriteBatchSize
+	PostgresURL           string
+	InfluxURL             string // http(s)://host:port for the v2 write API or udp://host:port
+	InfluxOrg             string
+	InfluxBucket          string
+	InfluxToken           string
+	InfluxMeasurement     string   `required:"true" default:"ping"`
+	InfluxTags            []string `required:"true" default:"device_id,hostname,ip"` // device_id, hostname, ip, family, device_type, or parent_device_id
+	FilePath              string   `required:"true" default:"-"`                     // - for stdout
+	FileFormat            string   `required:"true" default:"jsonl"`                 // jsonl or csv
+	FileMaxSize           int      `required:"true" default:"100"`                   // in megabytes, 0 to disable rotation
+	FileMaxBackups        int      `required:"true" default:"5"`
+	PrometheusURL         string
+	PrometheusHeaders     map[string]string // header:value
+	PrometheusRetries     int               `required:"true" default:"5"`
+	WriteBatchSize        int               `required:"true" default:"1000"`
+	WriteBufferSize       int               `required:"true" default:"10000"`
+	WriteConcurrency      int               `required:"true" default:"4"`
+	WriteOverflow         string            `required:"true" default:"drop-oldest"` // drop-oldest, drop-newest, or spool
+	SpoolDir              string            // empty to disable
+	SpoolMaxSize          int               `required:"true" default:"256"`     // in megabytes
+	SpoolSegmentSize      int               `required:"true" default:"16"`      // in megabytes
+	PurgeInterval         int               `required:"true" default:"60"`      // in minutes
+	PurgeOlderThan        int               `required:"true" default:"1440"`    // in minutes
+	DeviceSource          string            `required:"true" default:"graphql"` // graphql or file
+	DeviceFile            string            // .yaml, .yml, .json, or .csv
+	DeviceFileInterval    int               `required:"true" default:"30"` // in seconds
+	GraphQLEndpoint       string            // empty to disable
+	GraphQLAPISecret      string
 }
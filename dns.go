@@ -1,45 +1,247 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+//parseNameservers parses a comma-separated list of nameservers, adding port 53 to nameservers without a port
+func parseNameservers(list string) ([]string, error) {
+	servers := make([]string, 0)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(strings.Trim(s, "[]"), "53")
+		}
+		host, _, _ := net.SplitHostPort(s)
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("Invalid nameserver: %s", s)
+		}
+		servers = append(servers, s)
+	}
+	return servers, nil
+}
+
+//newResolver returns a pure-Go net.Resolver that sends queries to servers over protocol (udp or tcp), rotating
+//through servers so retries go to the next server. If servers is empty, the system nameservers are used: with the
+//system resolver for udp, or the pure-Go resolver (which reads the system configuration) for tcp
+func newResolver(servers []string, protocol string) *net.Resolver {
+	if len(servers) == 0 {
+		if protocol == "udp" {
+			return net.DefaultResolver
+		}
+		return &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := new(net.Dialer)
+				return d.DialContext(ctx, protocol, address)
+			},
+		}
+	}
+
+	var next uint64
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			server := servers[(atomic.AddUint64(&next, 1)-1)%uint64(len(servers))]
+			d := new(net.Dialer)
+			return d.DialContext(ctx, protocol, server)
+		},
+	}
+}
+
 //ResolverService is a service to resolve hostnames to IP addresses
 type ResolverService struct {
-	in chan *Device
+	failures uint64
+	in       chan *Device
+
+	protocol string
+	timeout  time.Duration
+
+	//resolvers are the resolvers for each list of nameservers, "" being the default
+	resolvers   map[string]*net.Resolver
+	resolversMu *sync.Mutex
+
+	lastLookup *time.Time
+	lastMu     *sync.Mutex
 }
 
-//NewResolverService returns a new ResolverService with the given number of workers
-func NewResolverService(workers int) *ResolverService {
-	r := &ResolverService{in: make(chan *Device)}
+//NewResolverService returns a new ResolverService with the given number of workers. Hostnames are resolved with
+//servers (a comma-separated list of nameservers, or the system resolver if empty) over protocol (udp or tcp), unless
+//a Device has its own Nameservers. Each lookup times out after timeout
+func NewResolverService(workers int, servers, protocol string, timeout time.Duration) (*ResolverService, error) {
+	if protocol != "udp" && protocol != "tcp" {
+		return nil, fmt.Errorf("Invalid protocol: %s", protocol)
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("Invalid timeout: %v", timeout)
+	}
+
+	r := &ResolverService{
+		in:          make(chan *Device),
+		protocol:    protocol,
+		timeout:     timeout,
+		resolvers:   make(map[string]*net.Resolver),
+		resolversMu: new(sync.Mutex),
+		lastMu:      new(sync.Mutex),
+	}
+
+	list, err := parseNameservers(servers)
+	if err != nil {
+		return nil, err
+	}
+	r.resolvers[""] = newResolver(list, protocol)
+	if len(list) > 0 {
+		log.Printf("ResolverService: Using nameservers %s over %s\n", strings.Join(list, ", "), protocol)
+	} else if protocol != "udp" {
+		log.Printf("ResolverService: Using system nameservers over %s\n", protocol)
+	}
+
 	log.Println("ResolverService: Starting", workers, "workers")
 	for i := 0; i < workers; i++ {
 		go r.resolver()
 	}
-	return r
+	return r, nil
+}
+
+//resolverFor returns the resolver for a Device's nameservers, falling back to the default resolver if they're invalid.
+//Invalid nameservers are only logged the first time they're seen
+func (r *ResolverService) resolverFor(nameservers *string) *net.Resolver {
+	key := ""
+	if nameservers != nil {
+		key = strings.TrimSpace(*nameservers)
+	}
+
+	r.resolversMu.Lock()
+	defer r.resolversMu.Unlock()
+
+	if res, ok := r.resolvers[key]; ok {
+		return res
+	}
+
+	list, err := parseNameservers(key)
+	if err != nil {
+		log.Printf("ResolverService: Unable to parse nameservers %q, using default: %v\n", key, err)
+		r.resolvers[key] = r.resolvers[""]
+		return r.resolvers[key]
+	}
+	res := newResolver(list, r.protocol)
+	r.resolvers[key] = res
+	return res
+}
+
+//lookup resolves hostname with res
+func (r *ResolverService) lookup(res *net.Resolver, hostname string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	addrs, err := res.LookupIPAddr(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, nil
+}
+
+//parseIP parses s as an IP address or an IP address with a prefix length (as Postgres formats inet), returning IPv4
+//addresses in their 4-byte form, or nil if s isn't valid
+func parseIP(s string) net.IP {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		var err error
+		if ip, _, err = net.ParseCIDR(s); err != nil {
+			return nil
+		}
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4
+	}
+	return ip
+}
+
+//containsIP returns true if ips contains ip
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *ResolverService) resolver() {
 	for d := range r.in {
-		ips, err := net.LookupIP(d.Hostname)
+		d.mu.RLock()
+		hostname, res := d.Hostname, r.resolverFor(d.Nameservers)
+		d.mu.RUnlock()
+
+		ips, err := r.lookup(res, hostname)
 		if err != nil {
-			log.Printf("ResolverService: Unable to lookup host %s: %v\n", d.Hostname, err)
+			log.Printf("ResolverService: Unable to lookup host %s: %v\n", hostname, err)
+			atomic.AddUint64(&r.failures, 1)
 			continue
 		}
 
+		now := time.Now()
+		r.lastMu.Lock()
+		r.lastLookup = &now
+		r.lastMu.Unlock()
+
 		d.mu.Lock()
-		d.ips = make([]net.IP, 0)
+		//static IPs are always pinged
+		d.ips = make([]net.IP, len(d.StaticIPs))
+		copy(d.ips, d.StaticIPs)
 		for _, ip := range ips {
 			if ipv4 := ip.To4(); ipv4 != nil {
-				d.ips = append(d.ips, ipv4)
+				ip = ipv4
+			} else if ip = ip.To16(); ip == nil {
+				continue
+			}
+			if !containsIP(d.ips, ip) {
+				d.ips = append(d.ips, ip)
 			}
 		}
 		d.mu.Unlock()
 	}
 }
 
-//Resolve resolves the IP Addresses for the given device
+//Resolve resolves the IP Addresses for the given device. Devices with NoDNS set are skipped
 func (r *ResolverService) Resolve(d *Device) {
+	d.mu.RLock()
+	noDNS := d.NoDNS
+	d.mu.RUnlock()
+	if noDNS {
+		return
+	}
 	r.in <- d
 }
+
+//Failures returns the number of failed lookups
+func (r *ResolverService) Failures() uint64 {
+	return atomic.LoadUint64(&r.failures)
+}
+
+//ResolverStatus is the status of the ResolverService
+type ResolverStatus struct {
+	LastLookup *time.Time `json:"last_lookup"`
+	Failures   uint64     `json:"failures"`
+}
+
+//Status returns the current status of the ResolverService
+func (r *ResolverService) Status() *ResolverStatus {
+	r.lastMu.Lock()
+	defer r.lastMu.Unlock()
+	return &ResolverStatus{LastLookup: r.lastLookup, Failures: r.Failures()}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//dnsServer is a stub nameserver answering every A query with ip over UDP and TCP. If silent is true, queries are
+//never answered
+type dnsServer struct {
+	udp    net.PacketConn
+	tcp    net.Listener
+	ip     net.IP
+	silent bool
+
+	queries map[string]int //by protocol
+	mu      *sync.Mutex
+}
+
+func newDNSServer(t *testing.T, ip string, silent bool) *dnsServer {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen on UDP: %v", err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		t.Fatalf("Unable to listen on TCP: %v", err)
+	}
+
+	s := &dnsServer{udp: udp, tcp: tcp, ip: net.ParseIP(ip).To4(), silent: silent, queries: make(map[string]int), mu: new(sync.Mutex)}
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+func (s *dnsServer) addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+func (s *dnsServer) close() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+func (s *dnsServer) count(protocol string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[protocol]
+}
+
+//answer returns the response to the query q, or nil if it should be ignored
+func (s *dnsServer) answer(protocol string, q []byte) []byte {
+	s.mu.Lock()
+	s.queries[protocol]++
+	s.mu.Unlock()
+	if s.silent || len(q) < 12 {
+		return nil
+	}
+
+	//skip the question name to find its type
+	i := 12
+	for i < len(q) && q[i] != 0 {
+		i += int(q[i]) + 1
+	}
+	if i+5 > len(q) {
+		return nil
+	}
+	question := q[12 : i+5]
+	qtype := binary.BigEndian.Uint16(q[i+1:])
+
+	resp := make([]byte, 12, 512)
+	copy(resp, q[:2])
+	binary.BigEndian.PutUint16(resp[2:], 0x8180)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	resp = append(resp, question...)
+	if qtype == 1 {
+		binary.BigEndian.PutUint16(resp[6:], 1)
+		//name pointer to the question, type A, class IN, TTL 60, 4 bytes
+		resp = append(resp, 0xC0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		resp = append(resp, s.ip...)
+	}
+	return resp
+}
+
+func (s *dnsServer) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.answer("udp", buf[:n]); resp != nil {
+			s.udp.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *dnsServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				var l uint16
+				if err := binary.Read(conn, binary.BigEndian, &l); err != nil {
+					return
+				}
+				q := make([]byte, l)
+				if _, err := io.ReadFull(conn, q); err != nil {
+					return
+				}
+				resp := s.answer("tcp", q)
+				if resp == nil {
+					continue
+				}
+				binary.Write(conn, binary.BigEndian, uint16(len(resp)))
+				conn.Write(resp)
+			}
+		}()
+	}
+}
+
+func TestParseNameservers(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+		err  bool
+	}{
+		{"", []string{}, false},
+		{"10.0.0.53", []string{"10.0.0.53:53"}, false},
+		{" 10.0.0.53:5353 , 2001:db8::53,[2001:db8::54]:5353", []string{"10.0.0.53:5353", "[2001:db8::53]:53", "[2001:db8::54]:5353"}, false},
+		{"ns1.example.com", nil, true},
+	}
+	for _, test := range tests {
+		got, err := parseNameservers(test.list)
+		if (err != nil) != test.err {
+			t.Errorf("%q: err = %v, want error: %v", test.list, err, test.err)
+			continue
+		}
+		if !test.err && !stringSlicesEqual(got, test.want) {
+			t.Errorf("%q = %v, want %v", test.list, got, test.want)
+		}
+	}
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//resolve resolves d with r and waits for its IPs to change
+func resolve(t *testing.T, r *ResolverService, d *Device) []net.IP {
+	t.Helper()
+	r.Resolve(d)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		d.mu.RLock()
+		ips := d.ips
+		d.mu.RUnlock()
+		if len(ips) > 0 {
+			return ips
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestResolverService(t *testing.T) {
+	def := newDNSServer(t, "192.0.2.1", false)
+	defer def.close()
+	other := newDNSServer(t, "192.0.2.2", false)
+	defer other.close()
+
+	tests := []struct {
+		name        string
+		protocol    string
+		nameservers *string
+		want        string
+		server      *dnsServer
+	}{
+		{"udp", "udp", nil, "192.0.2.1", def},
+		{"tcp", "tcp", nil, "192.0.2.1", def},
+		{"device nameservers", "udp", stringPtr(other.addr()), "192.0.2.2", other},
+		{"device nameservers over tcp", "tcp", stringPtr(other.addr()), "192.0.2.2", other},
+		{"invalid device nameservers", "udp", stringPtr("ns1.example.com"), "192.0.2.1", def},
+	}
+
+	for _, test := range tests {
+		r, err := NewResolverService(1, def.addr(), test.protocol, time.Second)
+		if err != nil {
+			t.Fatalf("%s: Unable to create ResolverService: %v", test.name, err)
+		}
+
+		before := test.server.count(test.protocol)
+		d := testDevice("1", "host.test.")
+		d.Nameservers = test.nameservers
+		ips := resolve(t, r, d)
+		if len(ips) != 1 || ips[0].String() != test.want {
+			t.Errorf("%s: ips = %v, want [%s]", test.name, ips, test.want)
+		}
+		if test.server.count(test.protocol) == before {
+			t.Errorf("%s: no queries received over %s", test.name, test.protocol)
+		}
+	}
+}
+
+func TestResolverServiceInvalidNameservers(t *testing.T) {
+	r, err := NewResolverService(0, "", "udp", time.Second)
+	if err != nil {
+		t.Fatalf("Unable to create ResolverService: %v", err)
+	}
+
+	//invalid nameservers are cached as the default resolver, so they're only logged once
+	res := r.resolverFor(stringPtr("ns1.example.com"))
+	if res != r.resolvers[""] {
+		t.Error("Invalid nameservers didn't use the default resolver")
+	}
+	if cached, ok := r.resolvers["ns1.example.com"]; !ok || cached != res {
+		t.Error("Invalid nameservers weren't cached")
+	}
+
+	if r.resolverFor(stringPtr("192.0.2.53")) == res {
+		t.Error("Valid nameservers used the default resolver")
+	}
+}
+
+func TestResolverServiceTimeout(t *testing.T) {
+	s := newDNSServer(t, "192.0.2.1", true)
+	defer s.close()
+
+	r, err := NewResolverService(1, s.addr(), "udp", 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unable to create ResolverService: %v", err)
+	}
+
+	start := time.Now()
+	if _, err = r.lookup(r.resolvers[""], "host.test."); err == nil {
+		t.Fatal("Expected lookup to time out")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("lookup took %v, want about 200ms", d)
+	}
+}
+
+func TestNewResolverSystemTCP(t *testing.T) {
+	if newResolver(nil, "udp") != net.DefaultResolver {
+		t.Error("udp without servers didn't use the system resolver")
+	}
+	//tcp without servers uses the system nameservers with the pure-Go resolver, which honors Dial
+	res := newResolver(nil, "tcp")
+	if res == net.DefaultResolver || !res.PreferGo || res.Dial == nil {
+		t.Error("tcp without servers didn't use a pure-Go resolver")
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//FileFormat is the format of records written by a FileSink
+type FileFormat string
+
+//Supported file formats
+const (
+	FileFormatJSONL FileFormat = "jsonl"
+	FileFormatCSV   FileFormat = "csv"
+)
+
+//probeColumns is the CSV header for probeRecords
+var probeColumns = []string{"device_id", "hostname", "ip", "identifier", "sequence", "sent_time", "recv_time", "rtt_us", "planned"}
+
+//probeRecord is a single Probe written by a FileSink
+type probeRecord struct {
+	DeviceID   string     `json:"device_id"`
+	Hostname   string     `json:"hostname"`
+	IP         string     `json:"ip"`
+	Identifier uint16     `json:"identifier"`
+	Sequence   uint16     `json:"sequence"`
+	SentTime   time.Time  `json:"sent_time"`
+	RecvTime   *time.Time `json:"recv_time"`
+	RTT        *int64     `json:"rtt_us"` //in microseconds, nil if no reply was received
+	Planned    bool       `json:"planned"`
+}
+
+func newProbeRecord(p *Ping, probe *Probe) *probeRecord {
+	r := &probeRecord{
+		DeviceID:   p.Device.ID,
+		Hostname:   p.Device.Hostname,
+		IP:         p.IP.String(),
+		Identifier: probe.Identifier,
+		Sequence:   probe.Sequence,
+		SentTime:   probe.SentTime,
+		RecvTime:   probe.RecvTime,
+		Planned:    p.Planned,
+	}
+	if rtt, ok := probe.RTT(); ok {
+		us := int64(rtt / time.Microsecond)
+		r.RTT = &us
+	}
+	return r
+}
+
+//csv returns the record as CSV fields in the order of probeColumns
+func (r *probeRecord) csv() []string {
+	var recv, rtt string
+	if r.RecvTime != nil {
+		recv = r.RecvTime.Format(time.RFC3339Nano)
+	}
+	if r.RTT != nil {
+		rtt = strconv.FormatInt(*r.RTT, 10)
+	}
+	return []string{
+		r.DeviceID, r.Hostname, r.IP,
+		strconv.Itoa(int(r.Identifier)), strconv.Itoa(int(r.Sequence)),
+		r.SentTime.Format(time.RFC3339Nano), recv, rtt,
+		strconv.FormatBool(r.Planned),
+	}
+}
+
+//FileSink is a ResultSink that writes every Probe of every Ping as JSON Lines or CSV to a file or stdout. Files are
+//rotated when they grow past a maximum size
+type FileSink struct {
+	path       string
+	format     FileFormat
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+	//header is true if the CSV header has been written to file
+	header bool
+	mu     *sync.Mutex
+}
+
+//NewFileSink returns a new FileSink writing records in format to path, or stdout if path is "-". If maxSize is greater
+//than 0, the file is rotated when it would grow past maxSize bytes, keeping up to maxBackups rotated files
+//(path.1 being the newest)
+func NewFileSink(path string, format FileFormat, maxSize int64, maxBackups int) (*FileSink, error) {
+	if format != FileFormatJSONL && format != FileFormatCSV {
+		return nil, fmt.Errorf("Invalid format: %s", format)
+	}
+
+	s := &FileSink{path: path, format: format, maxSize: maxSize, maxBackups: maxBackups, mu: new(sync.Mutex)}
+
+	if path == "-" {
+		s.file = os.Stdout
+		s.maxSize = 0
+		log.Printf("FileSink: Writing %s to stdout\n", format)
+		return s, nil
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("FileSink: Writing %s to %s\n", format, path)
+
+	return s, nil
+}
+
+//open opens or creates the file at s.path for appending
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open file: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Unable to stat file: %v", err)
+	}
+
+	s.file, s.size = f, info.Size()
+	//an existing file already has a header
+	s.header = s.size > 0
+	return nil
+}
+
+//rotate closes the current file, shifts existing backups, and opens a new file
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("Unable to close file: %v", err)
+	}
+
+	if s.maxBackups < 1 {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Unable to remove file: %v", err)
+		}
+		return s.open()
+	}
+
+	for i := s.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Unable to rotate backup: %v", err)
+		}
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return fmt.Errorf("Unable to rotate file: %v", err)
+	}
+
+	return s.open()
+}
+
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+//encode returns the records for pings in the FileSink's format. If header is true, the CSV header is included
+func (s *FileSink) encode(pings []*Ping, header bool) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if s.format == FileFormatJSONL {
+		e := json.NewEncoder(buf)
+		for _, p := range pings {
+			for _, probe := range p.Probes {
+				if err := e.Encode(newProbeRecord(p, probe)); err != nil {
+					return nil, fmt.Errorf("Unable to encode Probe: %v", err)
+				}
+			}
+		}
+		return buf.Bytes(), nil
+	}
+
+	w := csv.NewWriter(buf)
+	if header {
+		w.Write(probeColumns)
+	}
+	for _, p := range pings {
+		for _, probe := range p.Probes {
+			w.Write(newProbeRecord(p, probe).csv())
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, fmt.Errorf("Unable to encode Probes: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *FileSink) WritePings(pings []*Ping) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf, err := s.encode(pings, !s.header)
+	if err != nil {
+		return err
+	}
+
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(buf)) > s.maxSize {
+		if err = s.rotate(); err != nil {
+			return err
+		}
+		//the new file needs a header
+		if buf, err = s.encode(pings, !s.header); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(buf)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("Unable to write file: %v", err)
+	}
+	s.header = true
+
+	return nil
+}
+
+func (s *FileSink) WriteEvents(events []*Event) error {
+	return nil
+}
@@ -3,7 +3,12 @@ module github.com/korylprince/net-monitor-pinger
 go 1.14
 
 require (
+	github.com/gofrs/uuid v3.2.0+incompatible
+	github.com/golang/snappy v0.0.2
+	github.com/gorilla/websocket v1.4.2
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/korylprince/go-graphql-ws v0.3.4
 	github.com/korylprince/go-icmpv4/v2 v2.0.2
+	github.com/lib/pq v1.9.0
+	gopkg.in/yaml.v2 v2.4.0
 )
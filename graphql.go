@@ -1,13 +1,16 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gofrs/uuid"
 	"github.com/korylprince/go-graphql-ws"
 )
 
@@ -16,6 +19,38 @@ const gqlSubscribeDevices = `
 	  device {
 		id
 		hostname
+		ping_interval
+		ping_timeout
+		ping_count
+		ping_enabled
+		parent_device_id
+		no_dns
+		subnet
+		nameservers
+		static_ips {
+		  ip
+		}
+		device_type {
+		  id
+		  name
+		  ping_interval
+		  ping_timeout
+		  ping_count
+		  ping_enabled
+		}
+	  }
+	}
+`
+
+const gqlSubscribeMaintenance = `
+	subscription get_maintenance_windows {
+	  maintenance_window {
+		id
+		device_id
+		device_type_id
+		start_time
+		end_time
+		recurrence
 	  }
 	}
 `
@@ -28,6 +63,54 @@ const gqlInsertPings = `
 	}
 `
 
+//gqlReplayPings ignores Pings that were already inserted, e.g. by a replay that was interrupted
+const gqlReplayPings = `
+	mutation replay_ping($pings: [ping_insert_input!]!) {
+	  insert_ping(objects: $pings, on_conflict: {constraint: ping_pkey, update_columns: []}) {
+		affected_rows
+	  }
+	}
+`
+
+const gqlInsertEvents = `
+	mutation insert_device_event($events: [device_event_insert_input!]!) {
+	  insert_device_event(objects: $events) {
+		affected_rows
+	  }
+	}
+`
+
+//gqlReplayEvents ignores Events that were already inserted, e.g. by a replay that was interrupted
+const gqlReplayEvents = `
+	mutation replay_device_event($events: [device_event_insert_input!]!) {
+	  insert_device_event(objects: $events, on_conflict: {constraint: device_event_pkey, update_columns: []}) {
+		affected_rows
+	  }
+	}
+`
+
+const gqlUpsertDiscoveredHosts = `
+	mutation upsert_discovered_hosts($hosts: [discovered_host_insert_input!]!) {
+	  insert_discovered_host(
+		objects: $hosts,
+		on_conflict: {constraint: discovered_host_pkey, update_columns: [live, last_change], where: {live: {_eq: false}}}
+	  ) {
+		affected_rows
+	  }
+	}
+`
+
+const gqlLoseDiscoveredHosts = `
+	mutation lose_discovered_hosts($device_id: uuid!, $ips: [inet!]!, $time: timestamp!) {
+	  update_discovered_host(
+		where: {device_id: {_eq: $device_id}, ip: {_in: $ips}, live: {_eq: true}},
+		_set: {live: false, last_change: $time}
+	  ) {
+		affected_rows
+	  }
+	}
+`
+
 const gqlPurgePings = `
 	mutation purge_pings($time: timestamp!) {
 	  delete_ping(where: {sent_time: {_lt: $time}}) {
@@ -36,9 +119,29 @@ const gqlPurgePings = `
 	}
 `
 
+//GraphQLStatus is the status of the GraphQLService
+type GraphQLStatus struct {
+	Connected bool `json:"connected"`
+	//Since is when the connection was last opened or closed
+	Since time.Time `json:"since"`
+	//LastMutation is the time of the last successful mutation, and FailingSince is the time of the first failed
+	//mutation since then
+	LastMutation *time.Time `json:"last_mutation"`
+	FailingSince *time.Time `json:"failing_since"`
+	Reconnects   uint64     `json:"reconnects"`
+}
+
 type GraphQLService struct {
-	conn             *graphql.Conn
-	subscribeHandler func(devices []*Device)
+	reconnects uint64
+
+	//conn isn't safe for concurrent writes, so it's only used with connMu held
+	conn               *graphql.Conn
+	connMu             *sync.Mutex
+	subscribeHandler   func(devices []*Device)
+	maintenanceHandler func(windows []*MaintenanceWindow)
+
+	status   GraphQLStatus
+	statusMu *sync.Mutex
 }
 
 func NewGraphQLService(endpoint string, apiKey string) (*GraphQLService, error) {
@@ -50,9 +153,10 @@ func NewGraphQLService(endpoint string, apiKey string) (*GraphQLService, error)
 		return nil, fmt.Errorf("Unable to connect: %v", err)
 	}
 
-	g := &GraphQLService{conn: conn}
+	g := &GraphQLService{conn: conn, connMu: new(sync.Mutex), status: GraphQLStatus{Connected: true, Since: time.Now()}, statusMu: new(sync.Mutex)}
 	conn.SetCloseHandler(func(code int, text string) {
 		log.Println("GraphQLService: WebSocket closed:", text)
+		g.setConnected(false)
 		g.reconnect(endpoint, headers)
 	})
 
@@ -68,35 +172,182 @@ func (g *GraphQLService) reconnect(endpoint string, headers http.Header) {
 		time.Sleep(retry)
 		retry *= 2
 
+		atomic.AddUint64(&g.reconnects, 1)
 		conn, _, err := graphql.DefaultDialer.Dial(endpoint, headers, nil)
 		if err != nil {
 			log.Println("GraphQLService: Unable to reconnect:", err)
 			continue
 		}
 
+		g.connMu.Lock()
 		g.conn = conn
+		g.connMu.Unlock()
 		if g.subscribeHandler != nil {
 			if err = g.subscribeDevices(); err != nil {
 				log.Println("GraphQLService: Unable to resubscribe:", err)
 				continue
 			}
 		}
+		if g.maintenanceHandler != nil {
+			if err = g.subscribeMaintenance(); err != nil {
+				log.Println("GraphQLService: Unable to resubscribe to maintenance windows:", err)
+				continue
+			}
+		}
 
 		conn.SetCloseHandler(func(code int, text string) {
 			log.Println("GraphQLService: WebSocket closed:", text)
+			g.setConnected(false)
 			g.reconnect(endpoint, headers)
 		})
+		g.setConnected(true)
 		return
 	}
 }
 
+//gqlPermanentErrors are the Hasura error codes of mutations that will fail every time they're retried
+var gqlPermanentErrors = map[string]bool{
+	"constraint-violation": true,
+	"data-exception":       true,
+	"validation-failed":    true,
+	"permission-error":     true,
+	"parse-failed":         true,
+}
+
+//MutationError is an error returned by the GraphQL server for a mutation
+type MutationError struct {
+	Errors graphql.Errors
+}
+
+func (e *MutationError) Error() string {
+	return e.Errors.Error()
+}
+
+//Permanent returns true if the mutation was rejected and will fail every time it's retried, e.g. because of a
+//constraint violation
+func (e *MutationError) Permanent() bool {
+	for _, err := range e.Errors {
+		if code, ok := err.Extensions["code"].(string); ok && gqlPermanentErrors[code] {
+			return true
+		}
+	}
+	return false
+}
+
+//isPermanent returns true if err is a MutationError that will fail every time it's retried
+func isPermanent(err error) bool {
+	e, ok := err.(*MutationError)
+	return ok && e.Permanent()
+}
+
+//subscribe starts a subscription for q on the current connection and returns its id and connection
+func (g *GraphQLService) subscribe(q *graphql.MessagePayloadStart, f func(m *graphql.Message)) (string, *graphql.Conn, error) {
+	g.connMu.Lock()
+	defer g.connMu.Unlock()
+	id, err := g.conn.Subscribe(q, f)
+	return id, g.conn, err
+}
+
+//exec executes q and returns its result. It's the same as graphql.Conn.Execute, but only holds connMu while writing
+//to the connection, so mutations can run concurrently without concurrent writes
+func (g *GraphQLService) exec(q *graphql.MessagePayloadStart) (data *graphql.MessagePayloadData, err error) {
+	//data and complete Messages are handled concurrently, so both must fit
+	msgs := make(chan *graphql.Message, 2)
+	id, conn, err := g.subscribe(q, func(m *graphql.Message) { msgs <- m })
+	if err != nil {
+		return nil, fmt.Errorf("Unable to subscribe: %v", err)
+	}
+
+	defer func() {
+		g.connMu.Lock()
+		uErr := conn.Unsubscribe(id)
+		g.connMu.Unlock()
+		if err == nil && uErr != nil {
+			err = fmt.Errorf("Unable to unsubscribe: %v", uErr)
+		}
+	}()
+
+	for {
+		m := <-msgs
+		switch m.Type {
+		case graphql.MessageTypeComplete:
+			continue
+		case graphql.MessageTypeData:
+			data = new(graphql.MessagePayloadData)
+			if err = json.Unmarshal(m.Payload, data); err != nil {
+				return nil, fmt.Errorf("Unable to unmarshal %s message payload: %v", graphql.MessageTypeData, err)
+			}
+			return data, nil
+		case graphql.MessageTypeError:
+			return nil, graphql.ParseError(m.Payload)
+		default:
+			return nil, fmt.Errorf("Unexpected message type: %s", m.Type)
+		}
+	}
+}
+
+//execute executes the mutation q and unmarshals its data into r. Errors returned by the server are returned as a
+//*MutationError
+func (g *GraphQLService) execute(q *graphql.MessagePayloadStart, r interface{}) error {
+	data, err := g.exec(q)
+	if errs, ok := err.(graphql.Errors); ok {
+		return &MutationError{Errors: errs}
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to execute mutation: %v", err)
+	}
+	if len(data.Errors) > 0 {
+		return &MutationError{Errors: data.Errors}
+	}
+
+	if err = json.Unmarshal(data.Data, r); err != nil {
+		return fmt.Errorf("Unable to parse response: %v", err)
+	}
+	return nil
+}
+
+//Reconnects returns the number of reconnection attempts
+func (g *GraphQLService) Reconnects() uint64 {
+	return atomic.LoadUint64(&g.reconnects)
+}
+
+func (g *GraphQLService) setConnected(connected bool) {
+	g.statusMu.Lock()
+	g.status.Connected = connected
+	g.status.Since = time.Now()
+	g.statusMu.Unlock()
+}
+
+//mutated records the result of a mutation and returns err
+func (g *GraphQLService) mutated(err error) error {
+	now := time.Now()
+	g.statusMu.Lock()
+	if err == nil {
+		g.status.LastMutation = &now
+		g.status.FailingSince = nil
+	} else if g.status.FailingSince == nil {
+		g.status.FailingSince = &now
+	}
+	g.statusMu.Unlock()
+	return err
+}
+
+//Status returns the current status of the GraphQLService
+func (g *GraphQLService) Status() *GraphQLStatus {
+	g.statusMu.Lock()
+	s := g.status
+	g.statusMu.Unlock()
+	s.Reconnects = g.Reconnects()
+	return &s
+}
+
 func (g *GraphQLService) subscribeDevices() error {
 	type response struct {
 		Devices []*Device `json:"device"`
 	}
 
 	var q = &graphql.MessagePayloadStart{Query: gqlSubscribeDevices}
-	_, err := g.conn.Subscribe(q, func(m *graphql.Message) {
+	_, _, err := g.subscribe(q, func(m *graphql.Message) {
 		p := new(graphql.MessagePayloadData)
 		if err := json.Unmarshal(m.Payload, p); err != nil {
 			log.Println("GraphQLService: Unable to unmarshal payload:", err)
@@ -119,33 +370,133 @@ func (g *GraphQLService) SubscribeDevices(f func(devices []*Device)) error {
 	return g.subscribeDevices()
 }
 
-func (g *GraphQLService) InsertPings(reqs []*Ping) error {
-	type ping struct {
-		DeviceID string    `json:"device_id"`
-		IP       string    `json:"ip"`
-		SentTime time.Time `json:"sent_time"`
-		RTT      *int64    `json:"rtt"`
+func (g *GraphQLService) subscribeMaintenance() error {
+	type response struct {
+		Windows []*MaintenanceWindow `json:"maintenance_window"`
 	}
 
-	type response struct {
-		InsertPing struct {
-			AffectedRows int `json:"affected_rows"`
-		} `json:"insert_ping"`
+	var q = &graphql.MessagePayloadStart{Query: gqlSubscribeMaintenance}
+	_, _, err := g.subscribe(q, func(m *graphql.Message) {
+		p := new(graphql.MessagePayloadData)
+		if err := json.Unmarshal(m.Payload, p); err != nil {
+			log.Println("GraphQLService: Unable to unmarshal payload:", err)
+			return
+		}
+
+		r := new(response)
+		if err := json.Unmarshal(p.Data, r); err != nil {
+			log.Println("GraphQLService: Unable to unmarshal data:", err)
+			return
+		}
+		g.maintenanceHandler(r.Windows)
+	})
+
+	return err
+}
+
+//SubscribeMaintenance calls f with every MaintenanceWindow each time they change
+func (g *GraphQLService) SubscribeMaintenance(f func(windows []*MaintenanceWindow)) error {
+	g.maintenanceHandler = f
+	return g.subscribeMaintenance()
+}
+
+//pingRow is a row in the ping table
+type pingRow struct {
+	DeviceID  string    `json:"device_id"`
+	IP        string    `json:"ip"`
+	SentTime  time.Time `json:"sent_time"`
+	RTT       *int64    `json:"rtt"`
+	Probes    int       `json:"probes"`
+	Lost      int       `json:"lost"`
+	RTTMin    *float64  `json:"rtt_min"`
+	RTTMax    *float64  `json:"rtt_max"`
+	RTTStdDev *float64  `json:"rtt_stddev"`
+	Jitter    *float64  `json:"jitter"`
+	Planned   bool      `json:"planned"`
+}
+
+//newPingRows returns the ping table rows for reqs
+func newPingRows(reqs []*Ping) []*pingRow {
+	ms := func(d time.Duration) *float64 {
+		f := float64(d) / float64(time.Millisecond)
+		return &f
 	}
 
-	pings := make([]*ping, 0, len(reqs))
+	pings := make([]*pingRow, 0, len(reqs))
 	for _, r := range reqs {
-		p := &ping{
+		p := &pingRow{
 			DeviceID: r.Device.ID,
 			IP:       r.IP.String(),
 			SentTime: r.SentTime.UTC(),
+			Probes:   r.Sent,
+			Lost:     r.Sent - r.Received,
+			Planned:  r.Planned,
 		}
-		if r.RecvTime != nil {
-			rtt := r.RecvTime.Sub(r.SentTime).Milliseconds()
+		if r.Received > 0 {
+			rtt := r.AvgRTT.Milliseconds()
 			p.RTT = &rtt
+			p.RTTMin = ms(r.MinRTT)
+			p.RTTMax = ms(r.MaxRTT)
+			p.RTTStdDev = ms(r.StdDev)
+			p.Jitter = ms(r.Jitter)
 		}
 		pings = append(pings, p)
 	}
+	return pings
+}
+
+//eventRow is a row in the device_event table. ID is generated when the row is created, so a row that's inserted
+//more than once, e.g. when it's replayed from the Spool, is only stored once
+type eventRow struct {
+	ID            string    `json:"id,omitempty"`
+	DeviceID      string    `json:"device_id"`
+	IP            *string   `json:"ip"`
+	Time          time.Time `json:"time"`
+	PreviousState State     `json:"previous_state"`
+	State         State     `json:"state"`
+	Flapping      bool      `json:"flapping"`
+	Planned       bool      `json:"planned"`
+}
+
+//newEventRows returns the device_event table rows for reqs
+func newEventRows(reqs []*Event) []*eventRow {
+	events := make([]*eventRow, 0, len(reqs))
+	for _, r := range reqs {
+		e := &eventRow{
+			DeviceID:      r.Device.ID,
+			Time:          r.Time.UTC(),
+			PreviousState: r.PreviousState,
+			State:         r.State,
+			Flapping:      r.Flapping,
+			Planned:       r.Planned,
+		}
+		//without an ID, the database generates one
+		if id, err := uuid.NewV4(); err == nil {
+			e.ID = id.String()
+		}
+		if r.IP != nil {
+			ip := r.IP.String()
+			e.IP = &ip
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func (g *GraphQLService) InsertPings(reqs []*Ping) error {
+	return g.insertPingRows(newPingRows(reqs), false)
+}
+
+//insertPingRows inserts pings. If replay is true, Pings that were already inserted are ignored instead of failing
+//the mutation
+func (g *GraphQLService) insertPingRows(pings []*pingRow, replay bool) (err error) {
+	defer func() { g.mutated(err) }()
+
+	type response struct {
+		InsertPing struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"insert_ping"`
+	}
 
 	var q = &graphql.MessagePayloadStart{
 		Query: gqlInsertPings,
@@ -153,25 +504,62 @@ func (g *GraphQLService) InsertPings(reqs []*Ping) error {
 			"pings": pings,
 		},
 	}
+	if replay {
+		q.Query = gqlReplayPings
+	}
 
-	data, err := g.conn.Execute(context.Background(), q)
-	if err != nil {
-		return fmt.Errorf("Unable to execute mutation: %v", err)
+	r := new(response)
+	if err = g.execute(q, r); err != nil {
+		return err
+	}
+
+	if !replay && r.InsertPing.AffectedRows != len(pings) {
+		return fmt.Errorf("Unable to insert all pings: Sent: %d, Inserted: %d", len(pings), r.InsertPing.AffectedRows)
+	}
+
+	return nil
+}
+
+func (g *GraphQLService) InsertEvents(reqs []*Event) error {
+	return g.insertEventRows(newEventRows(reqs), false)
+}
+
+//insertEventRows inserts events. If replay is true, Events that were already inserted are ignored instead of failing
+//the mutation
+func (g *GraphQLService) insertEventRows(events []*eventRow, replay bool) (err error) {
+	defer func() { g.mutated(err) }()
+
+	type response struct {
+		InsertEvent struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"insert_device_event"`
+	}
+
+	var q = &graphql.MessagePayloadStart{
+		Query: gqlInsertEvents,
+		Variables: map[string]interface{}{
+			"events": events,
+		},
+	}
+	if replay {
+		q.Query = gqlReplayEvents
 	}
 
 	r := new(response)
-	if err = json.Unmarshal(data.Data, r); err != nil {
-		return fmt.Errorf("Unable to parse response: %v", err)
+	if err = g.execute(q, r); err != nil {
+		return err
 	}
 
-	if r.InsertPing.AffectedRows != len(reqs) {
-		return fmt.Errorf("Unable to insert all pings: Sent: %d, Inserted: %d", len(reqs), r.InsertPing.AffectedRows)
+	if !replay && r.InsertEvent.AffectedRows != len(events) {
+		return fmt.Errorf("Unable to insert all events: Sent: %d, Inserted: %d", len(events), r.InsertEvent.AffectedRows)
 	}
 
 	return nil
 }
 
-func (g *GraphQLService) PurgePings(before time.Time) error {
+func (g *GraphQLService) PurgePings(before time.Time) (err error) {
+	defer func() { g.mutated(err) }()
+
 	type response struct {
 		DeletePing struct {
 			AffectedRows int `json:"affected_rows"`
@@ -183,17 +571,69 @@ func (g *GraphQLService) PurgePings(before time.Time) error {
 		Variables: map[string]interface{}{"time": before.UTC()},
 	}
 
-	data, err := g.conn.Execute(context.Background(), q)
-	if err != nil {
-		return fmt.Errorf("Unable to execute mutation: %v", err)
-	}
-
 	r := new(response)
-	if err = json.Unmarshal(data.Data, r); err != nil {
-		return fmt.Errorf("Unable to parse response: %v", err)
+	if err = g.execute(q, r); err != nil {
+		return err
 	}
 
 	log.Println("GraphQLService: Purged", r.DeletePing.AffectedRows, "Pings")
 
 	return nil
 }
+
+//discoveredHostRow is a row in the discovered_host table
+type discoveredHostRow struct {
+	DeviceID   string    `json:"device_id"`
+	IP         string    `json:"ip"`
+	Live       bool      `json:"live"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastChange time.Time `json:"last_change"`
+}
+
+//UpdateDiscoveredHosts marks live hosts of the subnet sweep Device with the given id as live (adding them if they're
+//new), and lost hosts as not live, as of t
+func (g *GraphQLService) UpdateDiscoveredHosts(id string, live, lost []net.IP, t time.Time) (err error) {
+	defer func() { g.mutated(err) }()
+
+	type response struct {
+		InsertDiscoveredHost struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"insert_discovered_host"`
+		UpdateDiscoveredHost struct {
+			AffectedRows int `json:"affected_rows"`
+		} `json:"update_discovered_host"`
+	}
+
+	t = t.UTC()
+	if len(live) > 0 {
+		rows := make([]*discoveredHostRow, 0, len(live))
+		for _, ip := range live {
+			rows = append(rows, &discoveredHostRow{DeviceID: id, IP: ip.String(), Live: true, FirstSeen: t, LastChange: t})
+		}
+
+		var q = &graphql.MessagePayloadStart{
+			Query:     gqlUpsertDiscoveredHosts,
+			Variables: map[string]interface{}{"hosts": rows},
+		}
+		if err = g.execute(q, new(response)); err != nil {
+			return err
+		}
+	}
+
+	if len(lost) > 0 {
+		ips := make([]string, 0, len(lost))
+		for _, ip := range lost {
+			ips = append(ips, ip.String())
+		}
+
+		var q = &graphql.MessagePayloadStart{
+			Query:     gqlLoseDiscoveredHosts,
+			Variables: map[string]interface{}{"device_id": id, "ips": ips, "time": t},
+		}
+		if err = g.execute(q, new(response)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//gqlRequest is an operation received by graphqlServer
+type gqlRequest struct {
+	Query     string                     `json:"query"`
+	Variables map[string]json.RawMessage `json:"variables"`
+}
+
+//gqlResponse is the result of an operation returned by a graphqlServer handler. If Errors isn't nil, it's returned
+//instead of Data
+type gqlResponse struct {
+	Data   interface{}   `json:"data,omitempty"`
+	Errors []interface{} `json:"errors,omitempty"`
+}
+
+//graphqlServer is a minimal GraphQL over WebSocket (graphql-ws) server. Every operation is passed to handler
+type graphqlServer struct {
+	*httptest.Server
+	handler func(r *gqlRequest) *gqlResponse
+
+	requests []*gqlRequest
+	mu       *sync.Mutex
+}
+
+func newGraphQLServer(handler func(r *gqlRequest) *gqlResponse) *graphqlServer {
+	s := &graphqlServer{handler: handler, requests: make([]*gqlRequest, 0), mu: new(sync.Mutex)}
+	upgrader := &websocket.Upgrader{Subprotocols: []string{"graphql-ws"}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s.serve(conn)
+	}))
+	return s
+}
+
+func (s *graphqlServer) url() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+func (s *graphqlServer) serve(conn *websocket.Conn) {
+	type message struct {
+		ID      string          `json:"id,omitempty"`
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload,omitempty"`
+	}
+
+	for {
+		msg := new(message)
+		if err := conn.ReadJSON(msg); err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case "connection_init":
+			conn.WriteJSON(&message{Type: "connection_ack"})
+		case "start":
+			r := new(gqlRequest)
+			json.Unmarshal(msg.Payload, r)
+			s.mu.Lock()
+			s.requests = append(s.requests, r)
+			s.mu.Unlock()
+
+			//subscriptions are never answered
+			if strings.HasPrefix(strings.TrimSpace(r.Query), "subscription") {
+				continue
+			}
+			payload, _ := json.Marshal(s.handler(r))
+			conn.WriteJSON(&message{ID: msg.ID, Type: "data", Payload: payload})
+			conn.WriteJSON(&message{ID: msg.ID, Type: "complete"})
+		}
+	}
+}
+
+//received returns the operations received whose query contains name
+func (s *graphqlServer) received(name string) []*gqlRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reqs := make([]*gqlRequest, 0)
+	for _, r := range s.requests {
+		if strings.Contains(r.Query, name) {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs
+}
+
+//affected returns a handler that reports every row of the variable v as affected by the mutation field
+func affected(field, v string) func(r *gqlRequest) *gqlResponse {
+	return func(r *gqlRequest) *gqlResponse {
+		var rows []json.RawMessage
+		json.Unmarshal(r.Variables[v], &rows)
+		return &gqlResponse{Data: map[string]interface{}{field: map[string]int{"affected_rows": len(rows)}}}
+	}
+}
+
+func TestGraphQLSinkConcurrentWrites(t *testing.T) {
+	s := newGraphQLServer(affected("insert_ping", "pings"))
+	defer s.Close()
+
+	g, err := NewGraphQLService(s.url(), "secret")
+	if err != nil {
+		t.Fatalf("Unable to create GraphQLService: %v", err)
+	}
+	w, err := newSinkWriter(NewGraphQLSink(g, nil, 1, time.Hour), NewMetrics(), time.Hour, 1, 1000, 8, OverflowDropOldest)
+	if err != nil {
+		t.Fatalf("Unable to create sinkWriter: %v", err)
+	}
+
+	d := testDevice("1", "router")
+	const count = 200
+	for i := 0; i < count; i++ {
+		w.b.Add(&Ping{Device: d, IP: net.ParseIP("192.0.2.1"), SentTime: time.Unix(int64(i), 0), Sent: 1, Received: 1}, nil)
+	}
+
+	//every batch is a separate mutation, with up to 8 running at once from each flush, sharing one connection
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.flush()
+		}()
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.received("insert_ping")) < count && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(s.received("insert_ping")); n != count {
+		t.Errorf("mutations = %d, want %d", n, count)
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for g.Status().LastMutation == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := g.Status(); st.LastMutation == nil || st.FailingSince != nil {
+		t.Errorf("status = %+v, want successful mutations", st)
+	}
+}
+
+func TestGraphQLServiceMutationErrors(t *testing.T) {
+	s := newGraphQLServer(func(r *gqlRequest) *gqlResponse {
+		return &gqlResponse{Errors: []interface{}{map[string]interface{}{
+			"message":    "Foreign key violation",
+			"extensions": map[string]string{"code": "constraint-violation"},
+		}}}
+	})
+	defer s.Close()
+
+	g, err := NewGraphQLService(s.url(), "secret")
+	if err != nil {
+		t.Fatalf("Unable to create GraphQLService: %v", err)
+	}
+
+	err = g.InsertPings([]*Ping{{Device: testDevice("1", "router"), IP: net.ParseIP("192.0.2.1"), SentTime: time.Now(), Sent: 1}})
+	if !isPermanent(err) {
+		t.Errorf("err = %v, want a permanent MutationError", err)
+	}
+	if st := g.Status(); st.FailingSince == nil {
+		t.Error("Failed mutation wasn't recorded")
+	}
+}
+
+func TestGraphQLServiceDiscoveredHosts(t *testing.T) {
+	var fail int32
+	s := newGraphQLServer(func(r *gqlRequest) *gqlResponse {
+		if atomic.LoadInt32(&fail) == 1 {
+			return &gqlResponse{Errors: []interface{}{map[string]interface{}{
+				"message":    "check constraint of an insert/update permission has failed",
+				"extensions": map[string]string{"code": "permission-error"},
+			}}}
+		}
+		return &gqlResponse{Data: map[string]interface{}{
+			"insert_discovered_host": map[string]int{"affected_rows": 1},
+			"update_discovered_host": map[string]int{"affected_rows": 1},
+			"delete_ping":            map[string]int{"affected_rows": 1},
+		}}
+	})
+	defer s.Close()
+
+	g, err := NewGraphQLService(s.url(), "secret")
+	if err != nil {
+		t.Fatalf("Unable to create GraphQLService: %v", err)
+	}
+
+	now := time.Now()
+	live, lost := []net.IP{net.ParseIP("192.0.2.1")}, []net.IP{net.ParseIP("192.0.2.2")}
+	if err = g.UpdateDiscoveredHosts("1", live, lost, now); err != nil {
+		t.Fatalf("Unable to update discovered hosts: %v", err)
+	}
+	if n, m := len(s.received("upsert_discovered_hosts")), len(s.received("lose_discovered_hosts")); n != 1 || m != 1 {
+		t.Errorf("mutations = %d upserts, %d updates, want 1 each", n, m)
+	}
+	if err = g.PurgePings(now); err != nil {
+		t.Errorf("Unable to purge Pings: %v", err)
+	}
+
+	//errors returned by the server aren't successes
+	atomic.StoreInt32(&fail, 1)
+	if err = g.UpdateDiscoveredHosts("1", live, nil, now); !isPermanent(err) {
+		t.Errorf("UpdateDiscoveredHosts err = %v, want a permanent MutationError", err)
+	}
+	if err = g.UpdateDiscoveredHosts("1", nil, lost, now); !isPermanent(err) {
+		t.Errorf("UpdateDiscoveredHosts err = %v, want a permanent MutationError", err)
+	}
+	if err = g.PurgePings(now); !isPermanent(err) {
+		t.Errorf("PurgePings err = %v, want a permanent MutationError", err)
+	}
+	if st := g.Status(); st.FailingSince == nil {
+		t.Error("Failed mutations weren't recorded")
+	}
+}
+
+func TestGraphQLSinkReplayEvents(t *testing.T) {
+	//table is the device_event table, by id. While lost is set, inserts are stored but an error is returned, as if the
+	//response was lost
+	table := make(map[string]int)
+	var mu sync.Mutex
+	var lost int32 = 1
+	s := newGraphQLServer(func(r *gqlRequest) *gqlResponse {
+		var rows []*eventRow
+		json.Unmarshal(r.Variables["events"], &rows)
+		mu.Lock()
+		defer mu.Unlock()
+		inserted := 0
+		for _, row := range rows {
+			if table[row.ID] > 0 && strings.Contains(r.Query, "on_conflict") {
+				continue
+			}
+			table[row.ID]++
+			inserted++
+		}
+		if atomic.LoadInt32(&lost) == 1 {
+			return &gqlResponse{Errors: []interface{}{map[string]interface{}{
+				"message":    "connection to database lost",
+				"extensions": map[string]string{"code": "unexpected"},
+			}}}
+		}
+		return &gqlResponse{Data: map[string]interface{}{"insert_device_event": map[string]int{"affected_rows": inserted}}}
+	})
+	defer s.Close()
+
+	g, err := NewGraphQLService(s.url(), "secret")
+	if err != nil {
+		t.Fatalf("Unable to create GraphQLService: %v", err)
+	}
+	q := openSpool(t, tempDir(t), 1024*1024, 1024*1024)
+	sink := NewGraphQLSink(g, q, 10, 10*time.Millisecond)
+
+	d := testDevice("1", "router")
+	events := []*Event{
+		{Device: d, Time: time.Unix(1, 0), PreviousState: StateUp, State: StateDown},
+		{Device: d, IP: net.ParseIP("192.0.2.1"), Time: time.Unix(2, 0), PreviousState: StateUp, State: StateDown},
+	}
+	if err = sink.WriteEvents(events); err == nil || isPermanent(err) {
+		t.Fatalf("err = %v, want a temporary error", err)
+	}
+	if q.Size() == 0 {
+		t.Fatal("Failed Events weren't spooled")
+	}
+
+	atomic.StoreInt32(&lost, 0)
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Size() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if q.Size() != 0 {
+		t.Fatal("Spooled Events weren't replayed")
+	}
+
+	replays := s.received("replay_device_event")
+	if len(replays) == 0 || !strings.Contains(replays[0].Query, "on_conflict: {constraint: device_event_pkey") {
+		t.Errorf("replays = %d, want a mutation with on_conflict", len(replays))
+	}
+
+	//replaying the same rows again, e.g. after an interrupted replay, doesn't insert them twice
+	var rows []*eventRow
+	json.Unmarshal(replays[0].Variables["events"], &rows)
+	if err = g.insertEventRows(rows, true); err != nil {
+		t.Errorf("Unable to replay Events: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(table) != len(events) {
+		t.Errorf("rows = %d, want %d", len(table), len(events))
+	}
+	for id, n := range table {
+		if id == "" || n != 1 {
+			t.Errorf("row %q inserted %d times, want once with an id", id, n)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+//Health is the response of the health and readiness endpoints
+type Health struct {
+	OK        bool             `json:"ok"`
+	Failures  []string         `json:"failures,omitempty"`
+	GraphQL   *GraphQLStatus   `json:"graphql,omitempty"`
+	Ping      *PingStatus      `json:"ping"`
+	Resolver  *ResolverStatus  `json:"resolver"`
+	Scheduler *SchedulerStatus `json:"scheduler"`
+	Devices   int              `json:"devices"`
+	Synced    bool             `json:"synced"`
+}
+
+func (h *Health) fail(reason string) {
+	h.OK = false
+	h.Failures = append(h.Failures, reason)
+}
+
+//status returns the status of the Manager's services
+func (m *Manager) status() *Health {
+	h := &Health{OK: true, Ping: m.p.Status(), Resolver: m.r.Status(), Scheduler: m.s.Status()}
+	if m.g != nil {
+		h.GraphQL = m.g.Status()
+	}
+	m.devMu.RLock()
+	h.Devices, h.Synced = len(m.devices), m.synced
+	m.devMu.RUnlock()
+	return h
+}
+
+//healthy returns the status of the Manager's services, failing only on local problems that a restart could fix:
+//no ICMP listeners, or the Scheduler hasn't run for longer than the health timeout. Remote dependencies are checked by
+//ready, so an outage of Hasura doesn't cause restarts
+func (m *Manager) healthy() *Health {
+	h := m.status()
+
+	listeners := 0
+	for _, n := range h.Ping.Listeners {
+		listeners += n
+	}
+	if listeners == 0 {
+		h.fail("no ICMP listeners")
+	}
+
+	if time.Since(h.Scheduler.LastRun) > m.healthTimeout {
+		h.fail("Scheduler stalled since " + h.Scheduler.LastRun.Format(time.RFC3339))
+	}
+
+	return h
+}
+
+//ready returns the status of the Manager's services, failing if pings can't currently be sent and stored:
+//healthy fails, the GraphQL connection (if configured) is down or mutations are failing, Devices haven't been synced,
+//or no lookups have succeeded
+func (m *Manager) ready() *Health {
+	h := m.healthy()
+
+	if h.GraphQL != nil {
+		if !h.GraphQL.Connected {
+			h.fail("GraphQL disconnected since " + h.GraphQL.Since.Format(time.RFC3339))
+		}
+		if f := h.GraphQL.FailingSince; f != nil {
+			h.fail("GraphQL mutations failing since " + f.Format(time.RFC3339))
+		}
+	}
+	if !h.Synced {
+		h.fail("Devices not synced")
+	}
+	if h.Resolver.LastLookup == nil && m.resolving() > 0 {
+		h.fail("no successful DNS lookups")
+	}
+
+	return h
+}
+
+//healthHandler returns an http.Handler that writes the result of f as JSON, with a 503 status on failure
+func healthHandler(f func() *Health) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := f()
+		w.Header().Set("Content-Type", "application/json")
+		if !h.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(h)
+	})
+}
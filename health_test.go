@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testManager returns a Manager that's healthy and ready, with a connected GraphQLService and a synced Device
+func testManager() *Manager {
+	now := time.Now()
+	s := testScheduler(time.Second, 10)
+	s.lastRun = now
+
+	d := testDevice("1", "router")
+	return &Manager{
+		r: &ResolverService{lastLookup: &now, lastMu: new(sync.Mutex)},
+		p: &PingService{
+			senders:   map[Family][]*sender{FamilyIPv4: {{conn: &echoConn{family: FamilyIPv4}, identifier: 1}}},
+			pending:   make(map[probeKey]*Probe),
+			pendingMu: new(sync.RWMutex),
+		},
+		g:             &GraphQLService{status: GraphQLStatus{Connected: true, Since: now, LastMutation: &now}, statusMu: new(sync.Mutex)},
+		s:             s,
+		x:             NewMetrics(),
+		devices:       map[string]*Device{d.ID: d},
+		synced:        true,
+		devMu:         new(sync.RWMutex),
+		healthTimeout: time.Minute,
+	}
+}
+
+func TestManagerHealth(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(m *Manager)
+		healthy bool
+		ready   bool
+	}{
+		{"ok", func(m *Manager) {}, true, true},
+		{"no listeners", func(m *Manager) { m.p.senders = make(map[Family][]*sender) }, false, false},
+		{"scheduler stalled", func(m *Manager) { m.s.lastRun = time.Now().Add(-2 * time.Minute) }, false, false},
+		//remote problems only fail readiness
+		{"graphql disconnected", func(m *Manager) { m.g.status.Connected = false }, true, false},
+		{"graphql failing", func(m *Manager) {
+			now := time.Now()
+			m.g.status.FailingSince = &now
+		}, true, false},
+		{"graphql not configured", func(m *Manager) { m.g = nil }, true, true},
+		{"not synced", func(m *Manager) { m.synced = false }, true, false},
+		{"no lookups", func(m *Manager) { m.r.lastLookup = nil }, true, false},
+		{"no lookups needed", func(m *Manager) {
+			m.r.lastLookup = nil
+			m.devices["1"].NoDNS = true
+		}, true, true},
+	}
+
+	for _, test := range tests {
+		m := testManager()
+		test.modify(m)
+		h := m.Handler()
+
+		for _, path := range []string{"/healthz", "/readyz"} {
+			want := test.healthy
+			if path == "/readyz" {
+				want = test.ready
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			if ok := w.Code == http.StatusOK; ok != want {
+				t.Errorf("%s %s: status = %d, want ok: %v", test.name, path, w.Code, want)
+			}
+
+			health := new(Health)
+			if err := json.NewDecoder(w.Body).Decode(health); err != nil {
+				t.Errorf("%s %s: Unable to decode response: %v", test.name, path, err)
+				continue
+			}
+			if health.OK != want || (len(health.Failures) == 0) != want {
+				t.Errorf("%s %s: ok = %v, failures = %v, want ok: %v", test.name, path, health.OK, health.Failures, want)
+			}
+		}
+	}
+}
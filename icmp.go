@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/korylprince/go-icmpv4/v2"
+	"github.com/korylprince/go-icmpv4/v2/echo"
+)
+
+//ICMPv6 Echo Request/Reply types
+const (
+	icmpv6EchoRequest uint8 = 128
+	icmpv6EchoReply   uint8 = 129
+)
+
+//SocketMode is the kind of ICMP socket used to send and receive pings
+type SocketMode string
+
+//Supported socket modes. SocketModeAuto tries a raw socket first and falls back to an unprivileged socket
+const (
+	SocketModeAuto         SocketMode = "auto"
+	SocketModeRaw          SocketMode = "raw"
+	SocketModeUnprivileged SocketMode = "unprivileged"
+)
+
+//echoConn is a long-lived ICMP socket for a single address family. It's used to send every Echo Request
+//for the family and to receive every Echo Reply, so it's safe to use from multiple goroutines.
+//
+//Raw sockets require root or CAP_NET_RAW and receive every ICMP packet sent to the host, so replies are
+//filtered by identifier. Unprivileged (datagram) sockets are allowed by net.ipv4.ping_group_range on Linux;
+//the kernel rewrites the identifier to the socket's local port and only delivers replies for this socket
+type echoConn struct {
+	family      Family
+	privileged  bool
+	identifiers []uint16
+	conn        net.PacketConn
+}
+
+//randomIdentifiers returns n unique, random identifiers
+func randomIdentifiers(n int) ([]uint16, error) {
+	ids := make([]uint16, 0, n)
+	seen := make(map[uint16]struct{})
+	b := make([]byte, 2)
+	for len(ids) < n {
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("Unable to generate identifier: %v", err)
+		}
+		id := uint16(b[0])<<8 | uint16(b[1])
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+//listenRaw opens a raw echoConn for the given family and number of identifiers, listening on all addresses
+func listenRaw(family Family, identifiers int) (*echoConn, error) {
+	ids, err := randomIdentifiers(identifiers)
+	if err != nil {
+		return nil, err
+	}
+
+	network, laddr := "ip4:icmp", &net.IPAddr{IP: net.IPv4zero}
+	if family == FamilyIPv6 {
+		network, laddr = "ip6:ipv6-icmp", &net.IPAddr{IP: net.IPv6unspecified}
+	}
+
+	conn, err := net.ListenIP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &echoConn{family: family, privileged: true, identifiers: ids, conn: conn}, nil
+}
+
+//listenUnprivilegedN opens n unprivileged echoConns for the given family, since each socket has a single identifier
+func listenUnprivilegedN(family Family, n int) ([]*echoConn, error) {
+	conns := make([]*echoConn, 0, n)
+	for i := 0; i < n; i++ {
+		c, err := listenUnprivileged(family)
+		if err != nil {
+			for _, c := range conns {
+				c.conn.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, c)
+	}
+	return conns, nil
+}
+
+//listenEcho opens echoConns for the given family and mode with the given total number of identifiers
+func listenEcho(family Family, mode SocketMode, identifiers int) ([]*echoConn, error) {
+	switch mode {
+	case SocketModeRaw:
+		c, err := listenRaw(family, identifiers)
+		if err != nil {
+			return nil, err
+		}
+		return []*echoConn{c}, nil
+	case SocketModeUnprivileged:
+		return listenUnprivilegedN(family, identifiers)
+	case SocketModeAuto:
+		c, err := listenRaw(family, identifiers)
+		if err == nil {
+			return []*echoConn{c}, nil
+		}
+		log.Printf("PingService: Unable to open raw %s socket, falling back to unprivileged sockets: %v\n", family, err)
+		return listenUnprivilegedN(family, identifiers)
+	}
+	return nil, fmt.Errorf("Unknown socket mode: %s", mode)
+}
+
+//marshal creates a raw Echo Request for the connection's family. ICMPv6 checksums are left empty because the kernel
+//calculates them (including the IPv6 pseudo-header) for ICMPv6 sockets
+func (c *echoConn) marshal(identifier, sequence uint16, payload []byte) []byte {
+	if c.family == FamilyIPv6 {
+		b := []byte{icmpv6EchoRequest, 0, 0, 0, byte(identifier >> 8), byte(identifier), byte(sequence >> 8), byte(sequence)}
+		return append(b, payload...)
+	}
+	p := echo.NewEchoRequest(identifier, sequence)
+	p.Body = payload
+	return p.Marshal()
+}
+
+//hasIdentifier returns true if the identifier belongs to the connection
+func (c *echoConn) hasIdentifier(identifier uint16) bool {
+	for _, id := range c.identifiers {
+		if id == identifier {
+			return true
+		}
+	}
+	return false
+}
+
+//Send sends an Echo Request to ip with the given identifier, sequence, and payload
+func (c *echoConn) Send(ip net.IP, identifier, sequence uint16, payload []byte) error {
+	var addr net.Addr = &net.UDPAddr{IP: ip}
+	if c.privileged {
+		addr = &net.IPAddr{IP: ip}
+	}
+	_, err := c.conn.WriteTo(c.marshal(identifier, sequence, payload), addr)
+	return err
+}
+
+//parse parses a raw ICMP packet and returns it if it's an Echo Reply, or nil otherwise
+func (c *echoConn) parse(b []byte) (*echo.Packet, error) {
+	if c.family == FamilyIPv4 {
+		pk, err := icmpv4.Parse(b)
+		if err != nil {
+			return nil, err
+		}
+		if pk.Type != 0 || pk.Code != 0 {
+			return nil, nil
+		}
+		return &echo.Packet{Packet: pk}, nil
+	}
+
+	//the kernel has already verified the ICMPv6 checksum
+	if len(b) < icmpv4.ICMPv4HeaderLength {
+		return nil, icmpv4.InvalidPacketError("Malformed headers")
+	}
+	if b[0] != icmpv6EchoReply || b[1] != 0 {
+		return nil, nil
+	}
+	return &echo.Packet{Packet: &icmpv4.Packet{
+		Type:          b[0],
+		Code:          b[1],
+		Checksum:      uint16(b[2])<<8 | uint16(b[3]),
+		HeaderOptions: icmpv4.HeaderOptions(uint32(b[4])<<24 | uint32(b[5])<<16 | uint32(b[6])<<8 | uint32(b[7])),
+		Body:          b[icmpv4.ICMPv4HeaderLength:],
+	}}, nil
+}
+
+//Listener reads Echo Replies from the connection and sends them and errors back on channels
+func (c *echoConn) Listener(replies chan<- *pong, errors chan<- error) {
+	buf := make([]byte, 65535)
+	for {
+		length, raddr, err := c.conn.ReadFrom(buf)
+		recv := time.Now()
+		if err != nil {
+			errors <- err
+			continue
+		}
+
+		pk, err := c.parse(buf[:length])
+		if err != nil {
+			errors <- err
+			continue
+		}
+		if pk == nil {
+			continue
+		}
+
+		//raw sockets see replies to every process on the host
+		if c.privileged && !c.hasIdentifier(pk.Identifier()) {
+			continue
+		}
+
+		var ip net.IP
+		switch addr := raddr.(type) {
+		case *net.IPAddr:
+			ip = addr.IP
+		case *net.UDPAddr:
+			ip = addr.IP
+		default:
+			continue
+		}
+
+		payload := make([]byte, len(pk.Body))
+		copy(payload, pk.Body)
+
+		replies <- &pong{IP: ip, Identifier: pk.Identifier(), Sequence: pk.Sequence(), Payload: payload, RecvTime: recv}
+	}
+}
+
+func (c *echoConn) String() string {
+	mode := SocketModeUnprivileged
+	if c.privileged {
+		mode = SocketModeRaw
+	}
+	ids := make([]string, 0, len(c.identifiers))
+	for _, id := range c.identifiers {
+		ids = append(ids, strconv.Itoa(int(id)))
+	}
+	return fmt.Sprintf("%s (%s, identifiers %s)", c.conn.LocalAddr().String(), mode, strings.Join(ids, "/"))
+}
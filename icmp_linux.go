@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+//listenUnprivileged opens an unprivileged ICMP datagram ("ping") socket for the given family, listening on all addresses.
+//The user's group must be in net.ipv4.ping_group_range
+func listenUnprivileged(family Family) (*echoConn, error) {
+	domain, proto, sa := syscall.AF_INET, syscall.IPPROTO_ICMP, syscall.Sockaddr(&syscall.SockaddrInet4{})
+	if family == FamilyIPv6 {
+		domain, proto, sa = syscall.AF_INET6, syscall.IPPROTO_ICMPV6, &syscall.SockaddrInet6{}
+	}
+
+	s, err := syscall.Socket(domain, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err = syscall.Bind(s, sa); err != nil {
+		syscall.Close(s)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	f := os.NewFile(uintptr(s), fmt.Sprintf("icmp-%s", family))
+	conn, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	//the kernel uses the socket's local port as the identifier
+	laddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("Unexpected local address type: %T", conn.LocalAddr())
+	}
+
+	return &echoConn{family: family, identifiers: []uint16{uint16(laddr.Port)}, conn: conn}, nil
+}
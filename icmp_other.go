@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+//listenUnprivileged is only supported on Linux
+func listenUnprivileged(family Family) (*echoConn, error) {
+	return nil, fmt.Errorf("Unprivileged %s sockets are not supported on this platform", family)
+}
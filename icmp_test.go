@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/korylprince/go-icmpv4/v2"
+	"github.com/korylprince/go-icmpv4/v2/echo"
+)
+
+//packet is a packet read by a fakeConn
+type packet struct {
+	b    []byte
+	addr net.Addr
+}
+
+//fakeConn is a net.PacketConn that reads packets from a channel and records written packets
+type fakeConn struct {
+	packets chan *packet
+	written []*packet
+}
+
+func (c *fakeConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	p := <-c.packets
+	return copy(b, p.b), p.addr, nil
+}
+
+func (c *fakeConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.written = append(c.written, &packet{b: append([]byte(nil), b...), addr: addr})
+	return len(b), nil
+}
+
+func (c *fakeConn) Close() error                       { return nil }
+func (c *fakeConn) LocalAddr() net.Addr                { return &net.IPAddr{} }
+func (c *fakeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fakeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+//reply returns the Echo Reply to the Echo Request b, as sent by c
+func reply(t *testing.T, c *echoConn, b []byte) []byte {
+	t.Helper()
+	if c.family == FamilyIPv6 {
+		r := append([]byte(nil), b...)
+		r[0] = icmpv6EchoReply
+		return r
+	}
+	pk, err := icmpv4.Parse(b)
+	if err != nil {
+		t.Fatalf("Unable to parse Echo Request: %v", err)
+	}
+	pk.Type = 0
+	return pk.Marshal()
+}
+
+func TestEchoConnSendParse(t *testing.T) {
+	payload := []byte("payload")
+	for _, family := range []Family{FamilyIPv4, FamilyIPv6} {
+		for _, privileged := range []bool{true, false} {
+			fc := &fakeConn{}
+			c := &echoConn{family: family, privileged: privileged, identifiers: []uint16{1234}, conn: fc}
+			ip := net.ParseIP("192.0.2.1")
+			if family == FamilyIPv6 {
+				ip = net.ParseIP("2001:db8::1")
+			}
+			if err := c.Send(ip, 1234, 5, payload); err != nil {
+				t.Fatalf("%s, privileged %v: Unable to send: %v", family, privileged, err)
+			}
+
+			//raw sockets are addressed by IP, and unprivileged sockets by UDP address
+			w := fc.written[0]
+			if _, ok := w.addr.(*net.IPAddr); ok != privileged {
+				t.Errorf("%s, privileged %v: address = %T", family, privileged, w.addr)
+			}
+
+			//requests aren't replies
+			if pk, err := c.parse(w.b); pk != nil || err != nil {
+				t.Errorf("%s, privileged %v: parsed request = %v, %v, want nil", family, privileged, pk, err)
+			}
+
+			pk, err := c.parse(reply(t, c, w.b))
+			if err != nil || pk == nil {
+				t.Errorf("%s, privileged %v: Unable to parse reply: %v", family, privileged, err)
+				continue
+			}
+			if pk.Identifier() != 1234 || pk.Sequence() != 5 || !bytes.Equal(pk.Body, payload) {
+				t.Errorf("%s, privileged %v: reply = %d, %d, %q, want 1234, 5, %q", family, privileged, pk.Identifier(), pk.Sequence(), pk.Body, payload)
+			}
+		}
+	}
+}
+
+func TestEchoConnParseInvalid(t *testing.T) {
+	tests := []struct {
+		family Family
+		b      []byte
+	}{
+		{FamilyIPv4, []byte{0, 0, 0}},
+		//invalid checksum
+		{FamilyIPv4, []byte{0, 0, 0, 1, 0, 0, 0, 0}},
+		{FamilyIPv6, []byte{icmpv6EchoReply, 0, 0}},
+	}
+	for _, test := range tests {
+		c := &echoConn{family: test.family}
+		if _, err := c.parse(test.b); err == nil {
+			t.Errorf("%s, %v: err = nil, want an error", test.family, test.b)
+		}
+	}
+}
+
+func TestEchoConnListener(t *testing.T) {
+	tests := []struct {
+		privileged bool
+		identifier uint16
+		want       bool
+	}{
+		{true, 1, true},
+		{true, 2, true},
+		//raw sockets receive replies to every process on the host
+		{true, 3, false},
+		//the kernel only delivers replies for unprivileged sockets, after rewriting the identifier to the local port,
+		//so they aren't filtered
+		{false, 1, true},
+		{false, 3, true},
+	}
+
+	for _, test := range tests {
+		fc := &fakeConn{packets: make(chan *packet, 2)}
+		c := &echoConn{family: FamilyIPv4, privileged: test.privileged, identifiers: []uint16{1, 2}, conn: fc}
+		replies, errors := make(chan *pong, 2), make(chan error, 2)
+		go c.Listener(replies, errors)
+
+		ip := net.ParseIP("192.0.2.1").To4()
+		var addr net.Addr = &net.UDPAddr{IP: ip}
+		if test.privileged {
+			addr = &net.IPAddr{IP: ip}
+		}
+		fc.packets <- &packet{b: reply(t, c, c.marshal(test.identifier, 7, []byte("payload"))), addr: addr}
+		//a reply that's always delivered, so the test doesn't wait for a filtered reply
+		fc.packets <- &packet{b: reply(t, c, c.marshal(1, 8, nil)), addr: addr}
+
+		select {
+		case p := <-replies:
+			if got := p.Sequence == 7; got != test.want {
+				t.Errorf("privileged %v, identifier %d: received = %v, want %v", test.privileged, test.identifier, got, test.want)
+			}
+			if p.Sequence == 7 && (!p.IP.Equal(ip) || p.Identifier != test.identifier || string(p.Payload) != "payload") {
+				t.Errorf("privileged %v, identifier %d: reply = %+v", test.privileged, test.identifier, p)
+			}
+		case err := <-errors:
+			t.Errorf("privileged %v, identifier %d: err = %v", test.privileged, test.identifier, err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("privileged %v, identifier %d: Timed out waiting for reply", test.privileged, test.identifier)
+		}
+	}
+}
+
+func TestListenEcho(t *testing.T) {
+	if _, err := listenEcho(FamilyIPv4, SocketMode("udp"), 1); err == nil {
+		t.Error("Unknown socket mode: err = nil, want an error")
+	}
+
+	tests := []struct {
+		mode       SocketMode
+		privileged bool
+		conns      int
+	}{
+		//raw sockets have every identifier, unprivileged sockets have one each
+		{SocketModeRaw, true, 1},
+		{SocketModeUnprivileged, false, 3},
+	}
+
+	for _, test := range tests {
+		conns, err := listenEcho(FamilyIPv4, test.mode, 3)
+		if err != nil {
+			t.Logf("%s: Unable to open ICMP socket: %v", test.mode, err)
+			continue
+		}
+		ids := make(map[uint16]struct{})
+		for _, c := range conns {
+			if c.privileged != test.privileged {
+				t.Errorf("%s: privileged = %v, want %v", test.mode, c.privileged, test.privileged)
+			}
+			for _, id := range c.identifiers {
+				ids[id] = struct{}{}
+			}
+			//the kernel rewrites the identifier of unprivileged sockets to the local port
+			if !c.privileged {
+				if port := c.conn.LocalAddr().(*net.UDPAddr).Port; len(c.identifiers) != 1 || int(c.identifiers[0]) != port {
+					t.Errorf("%s: identifiers = %v, want local port %d", test.mode, c.identifiers, port)
+				}
+			}
+			c.conn.Close()
+		}
+		if len(conns) != test.conns || len(ids) != 3 {
+			t.Errorf("%s: %d conns with %d identifiers, want %d with 3", test.mode, len(conns), len(ids), test.conns)
+		}
+	}
+
+	//auto mode prefers a raw socket
+	conns, err := listenEcho(FamilyIPv4, SocketModeAuto, 3)
+	if err != nil {
+		t.Skip("Unable to open ICMP socket:", err)
+	}
+	raw, rawErr := listenRaw(FamilyIPv4, 1)
+	if rawErr == nil {
+		raw.conn.Close()
+	}
+	if privileged := conns[0].privileged; privileged != (rawErr == nil) {
+		t.Errorf("auto: privileged = %v, raw socket error = %v", privileged, rawErr)
+	}
+	for _, c := range conns {
+		c.conn.Close()
+	}
+}
+
+//BenchmarkEchoConnSend sends Echo Requests to localhost with a shared, long-lived echoConn
+func BenchmarkEchoConnSend(b *testing.B) {
+	conns, err := listenEcho(FamilyIPv4, SocketModeAuto, 1)
+	if err != nil {
+		b.Skip("Unable to open ICMP socket:", err)
+	}
+	c := conns[0]
+	defer c.conn.Close()
+
+	ip := net.IPv4(127, 0, 0, 1).To4()
+	payload := make([]byte, 16)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err = c.Send(ip, c.identifiers[0], uint16(i), payload); err != nil {
+			b.Fatal("Unable to send:", err)
+		}
+	}
+}
+
+//BenchmarkDialSend sends Echo Requests to localhost by dialing a new socket for each one, as pings were sent before
+//echoConn
+func BenchmarkDialSend(b *testing.B) {
+	addr := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	if err := echo.Send(nil, addr, 1, 0); err != nil {
+		b.Skip("Unable to open ICMP socket:", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := echo.Send(nil, addr, 1, uint16(i)); err != nil {
+			b.Fatal("Unable to send:", err)
+		}
+	}
+}
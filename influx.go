@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//influxDatagramSize is the maximum size of a UDP datagram sent to InfluxDB
+const influxDatagramSize = 1400
+
+//InfluxTags are the Device fields that can be used as InfluxDB tags
+var InfluxTags = []string{"device_id", "hostname", "ip", "family", "device_type", "parent_device_id"}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	influxStringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+//InfluxSink is a ResultSink that writes results to InfluxDB in line protocol, either with the v2 HTTP write API
+//or to a UDP listener
+type InfluxSink struct {
+	measurement string
+	tags        []string
+
+	//writeURL, token, and client are used for HTTP
+	writeURL string
+	token    string
+	client   *http.Client
+
+	//conn is used for UDP
+	conn net.Conn
+}
+
+//NewInfluxSink returns a new InfluxSink. rawurl is the InfluxDB URL, e.g. "http://localhost:8086" or
+//"udp://localhost:8089". org, bucket, and token are only used for HTTP. Pings are written to measurement and Events
+//to measurement + "_event", tagged with the given Device fields (see InfluxTags)
+func NewInfluxSink(rawurl, org, bucket, token, measurement string, tags []string) (*InfluxSink, error) {
+	for _, t := range tags {
+		valid := false
+		for _, v := range InfluxTags {
+			if t == v {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("Invalid tag: %s", t)
+		}
+	}
+	sorted := make([]string, len(tags))
+	copy(sorted, tags)
+	//line protocol performs best with tags sorted by key
+	sort.Strings(sorted)
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse URL: %v", err)
+	}
+
+	s := &InfluxSink{measurement: measurement, tags: sorted}
+
+	switch u.Scheme {
+	case "http", "https":
+		if bucket == "" {
+			return nil, fmt.Errorf("Bucket is required")
+		}
+		q := make(url.Values)
+		q.Set("org", org)
+		q.Set("bucket", bucket)
+		q.Set("precision", "ns")
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+		u.RawQuery = q.Encode()
+		s.writeURL, s.token = u.String(), token
+		s.client = &http.Client{Timeout: 30 * time.Second}
+	case "udp":
+		if s.conn, err = net.Dial("udp", u.Host); err != nil {
+			return nil, fmt.Errorf("Unable to dial: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid URL scheme: %s", u.Scheme)
+	}
+
+	log.Printf("InfluxSink: Writing to %s://%s\n", u.Scheme, u.Host)
+
+	return s, nil
+}
+
+func (s *InfluxSink) Name() string {
+	return "influxdb"
+}
+
+//tagSet returns the line protocol tag set for d and ip, including the leading comma. Empty tags are omitted
+func (s *InfluxSink) tagSet(d *Device, ip net.IP) string {
+	b := new(strings.Builder)
+	for _, t := range s.tags {
+		var v string
+		switch t {
+		case "device_id":
+			v = d.ID
+		case "hostname":
+			v = d.Hostname
+		case "ip":
+			if ip != nil {
+				v = ip.String()
+			}
+		case "family":
+			if ip != nil {
+				v = familyOf(ip).String()
+			}
+		case "device_type":
+			if d.DeviceType != nil {
+				v = d.DeviceType.Name
+			}
+		case "parent_device_id":
+			if d.ParentDeviceID != nil {
+				v = *d.ParentDeviceID
+			}
+		}
+		if v != "" {
+			b.WriteString("," + influxTagEscaper.Replace(t) + "=" + influxTagEscaper.Replace(v))
+		}
+	}
+	return b.String()
+}
+
+//pingLine returns the line protocol for p
+func (s *InfluxSink) pingLine(p *Ping) string {
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64)
+	}
+
+	fields := []string{
+		"sent=" + strconv.Itoa(p.Sent) + "i",
+		"received=" + strconv.Itoa(p.Received) + "i",
+		"loss=" + strconv.FormatFloat(p.Loss, 'f', -1, 64),
+		"planned=" + strconv.FormatBool(p.Planned),
+	}
+	if p.Received > 0 {
+		fields = append(fields,
+			"rtt="+ms(p.AvgRTT),
+			"rtt_min="+ms(p.MinRTT),
+			"rtt_max="+ms(p.MaxRTT),
+			"rtt_stddev="+ms(p.StdDev),
+			"jitter="+ms(p.Jitter),
+		)
+	}
+
+	return fmt.Sprintf("%s%s %s %d\n", influxMeasurementEscaper.Replace(s.measurement), s.tagSet(p.Device, p.IP), strings.Join(fields, ","), p.SentTime.UnixNano())
+}
+
+//eventLine returns the line protocol for e
+func (s *InfluxSink) eventLine(e *Event) string {
+	fields := []string{
+		`state="` + influxStringEscaper.Replace(string(e.State)) + `"`,
+		`previous_state="` + influxStringEscaper.Replace(string(e.PreviousState)) + `"`,
+		"flapping=" + strconv.FormatBool(e.Flapping),
+		"planned=" + strconv.FormatBool(e.Planned),
+	}
+
+	return fmt.Sprintf("%s%s %s %d\n", influxMeasurementEscaper.Replace(s.measurement+"_event"), s.tagSet(e.Device, e.IP), strings.Join(fields, ","), e.Time.UnixNano())
+}
+
+//write sends lines to InfluxDB
+func (s *InfluxSink) write(lines []string) error {
+	if s.conn != nil {
+		buf := new(bytes.Buffer)
+		for i, l := range lines {
+			buf.WriteString(l)
+			if i == len(lines)-1 || buf.Len()+len(lines[i+1]) > influxDatagramSize {
+				if _, err := s.conn.Write(buf.Bytes()); err != nil {
+					return fmt.Errorf("Unable to write datagram: %v", err)
+				}
+				buf.Reset()
+			}
+		}
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.writeURL, strings.NewReader(strings.Join(lines, "")))
+	if err != nil {
+		return fmt.Errorf("Unable to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to POST lines: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Unexpected status: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return nil
+}
+
+func (s *InfluxSink) WritePings(pings []*Ping) error {
+	lines := make([]string, 0, len(pings))
+	for _, p := range pings {
+		lines = append(lines, s.pingLine(p))
+	}
+	return s.write(lines)
+}
+
+func (s *InfluxSink) WriteEvents(events []*Event) error {
+	lines := make([]string, 0, len(events))
+	for _, e := range events {
+		lines = append(lines, s.eventLine(e))
+	}
+	return s.write(lines)
+}
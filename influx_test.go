@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//influxRequest is a write received by the InfluxDB stub
+type influxRequest struct {
+	path  string
+	query map[string]string
+	auth  string
+	body  string
+}
+
+func TestInfluxSinkHTTP(t *testing.T) {
+	reqs := make(chan *influxRequest, 10)
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		q := make(map[string]string)
+		for k := range r.URL.Query() {
+			q[k] = r.URL.Query().Get(k)
+		}
+		code := status
+		reqs <- &influxRequest{path: r.URL.Path, query: q, auth: r.Header.Get("Authorization"), body: string(body)}
+		w.WriteHeader(code)
+	}))
+	defer srv.Close()
+
+	s, err := NewInfluxSink(srv.URL+"/", "my org", "pings", "secret", "ping", []string{"ip", "hostname", "device_type", "device_id", "parent_device_id"})
+	if err != nil {
+		t.Fatalf("Unable to create InfluxSink: %v", err)
+	}
+
+	d := testDevice("1", "core router")
+	d.DeviceType = &DeviceType{ID: "t", Name: "Switch"}
+	sent := time.Unix(1600000000, 5)
+	pings := []*Ping{
+		{Device: d, IP: net.ParseIP("192.0.2.1"), SentTime: sent, Sent: 2, Received: 2, MinRTT: time.Millisecond, AvgRTT: 1500 * time.Microsecond, MaxRTT: 2 * time.Millisecond, StdDev: 500 * time.Microsecond, Jitter: time.Millisecond},
+		{Device: d, IP: net.ParseIP("2001:db8::1"), SentTime: sent, Sent: 2, Received: 0, Loss: 100, Planned: true},
+	}
+	if err = s.WritePings(pings); err != nil {
+		t.Fatalf("Unable to write Pings: %v", err)
+	}
+
+	r := <-reqs
+	if r.path != "/api/v2/write" {
+		t.Errorf("path = %s, want /api/v2/write", r.path)
+	}
+	for k, v := range map[string]string{"org": "my org", "bucket": "pings", "precision": "ns"} {
+		if r.query[k] != v {
+			t.Errorf("%s = %q, want %q", k, r.query[k], v)
+		}
+	}
+	if r.auth != "Token secret" {
+		t.Errorf("Authorization = %q, want Token secret", r.auth)
+	}
+
+	want := []string{
+		`ping,device_id=1,device_type=Switch,hostname=core\ router,ip=192.0.2.1 sent=2i,received=2i,loss=0,planned=false,rtt=1.5,rtt_min=1,rtt_max=2,rtt_stddev=0.5,jitter=1 1600000000000000005`,
+		`ping,device_id=1,device_type=Switch,hostname=core\ router,ip=2001:db8::1 sent=2i,received=0i,loss=100,planned=true 1600000000000000005`,
+	}
+	if got := strings.Split(strings.TrimSuffix(r.body, "\n"), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("lines =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	events := []*Event{{Device: d, Time: sent, PreviousState: StateUp, State: StateDown, Flapping: true}}
+	if err = s.WriteEvents(events); err != nil {
+		t.Fatalf("Unable to write Events: %v", err)
+	}
+	r = <-reqs
+	if want := "ping_event,device_id=1,device_type=Switch,hostname=core\\ router state=\"down\",previous_state=\"up\",flapping=true,planned=false 1600000000000000005\n"; r.body != want {
+		t.Errorf("event line = %q, want %q", r.body, want)
+	}
+
+	status = http.StatusBadRequest
+	if err = s.WritePings(pings); err == nil {
+		t.Error("Expected error for 400 status")
+	}
+	<-reqs
+}
+
+func TestInfluxSinkUDP(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer l.Close()
+
+	s, err := NewInfluxSink("udp://"+l.LocalAddr().String(), "", "", "", "ping", []string{"device_id", "ip"})
+	if err != nil {
+		t.Fatalf("Unable to create InfluxSink: %v", err)
+	}
+
+	d := testDevice("1", strings.Repeat("a", 100))
+	pings := make([]*Ping, 0)
+	for i := 0; i < 50; i++ {
+		pings = append(pings, &Ping{Device: d, IP: net.IPv4(192, 0, 2, byte(i)), SentTime: time.Unix(0, int64(i)), Sent: 1, Received: 1, AvgRTT: time.Millisecond})
+	}
+	if err = s.WritePings(pings); err != nil {
+		t.Fatalf("Unable to write Pings: %v", err)
+	}
+
+	//lines are split across datagrams without splitting a line
+	lines := 0
+	buf := make([]byte, 65536)
+	for lines < len(pings) {
+		l.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := l.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Unable to read datagram after %d lines: %v", lines, err)
+		}
+		if n > influxDatagramSize {
+			t.Errorf("datagram size = %d, want at most %d", n, influxDatagramSize)
+		}
+		if buf[n-1] != '\n' {
+			t.Error("datagram doesn't end with a complete line")
+		}
+		lines += strings.Count(string(buf[:n]), "\n")
+	}
+	if lines != len(pings) {
+		t.Errorf("lines = %d, want %d", lines, len(pings))
+	}
+}
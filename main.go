@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"net/http"
 
 	"github.com/kelseyhightower/envconfig"
 )
@@ -10,10 +11,15 @@ func main() {
 	c := new(config)
 	envconfig.MustProcess("", c)
 
-	_, err := NewManager(c)
+	m, err := NewManager(c)
 	if err != nil {
 		log.Fatalln("Unable to create manager:", err)
 	}
 
-	select {}
+	if c.HTTPAddr == "" {
+		select {}
+	}
+
+	log.Println("Listening on:", c.HTTPAddr)
+	log.Fatalln("Unable to start HTTP server:", http.ListenAndServe(c.HTTPAddr, m.Handler()))
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//Recurrence is how often a MaintenanceWindow repeats
+type Recurrence string
+
+//Supported recurrences
+const (
+	RecurrenceNone    Recurrence = "none"
+	RecurrenceDaily   Recurrence = "daily"
+	RecurrenceWeekly  Recurrence = "weekly"
+	RecurrenceMonthly Recurrence = "monthly"
+)
+
+//timestamp is a Postgres TIMESTAMP WITHOUT TIME ZONE, stored in UTC
+type timestamp struct {
+	time.Time
+}
+
+func (t *timestamp) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseInLocation("2006-01-02T15:04:05.999999999", s, time.UTC)
+	if err != nil {
+		if v, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return fmt.Errorf("Unable to parse timestamp: %v", err)
+		}
+	}
+	t.Time = v
+	return nil
+}
+
+//MaintenanceWindow is a period of planned downtime for a Device, every Device of a DeviceType, or every Device if
+//both DeviceID and DeviceTypeID are nil
+type MaintenanceWindow struct {
+	ID           string     `json:"id"`
+	DeviceID     *string    `json:"device_id"`
+	DeviceTypeID *string    `json:"device_type_id"`
+	Start        timestamp  `json:"start_time"`
+	End          timestamp  `json:"end_time"`
+	Recurrence   Recurrence `json:"recurrence"`
+}
+
+//applies returns true if w covers d
+func (w *MaintenanceWindow) applies(d *Device) bool {
+	switch {
+	case w.DeviceID != nil:
+		return *w.DeviceID == d.ID
+	case w.DeviceTypeID != nil:
+		return d.DeviceType != nil && *w.DeviceTypeID == d.DeviceType.ID
+	}
+	return true
+}
+
+//addMonths returns t moved forward by months, on the same day of the month, or the last day of the month if it's
+//shorter
+func addMonths(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	day := t.Day()
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+//active returns true if t is inside w or one of its recurrences
+func (w *MaintenanceWindow) active(t time.Time) bool {
+	start, end := w.Start.UTC(), w.End.UTC()
+	if t.Before(start) {
+		return false
+	}
+	duration := end.Sub(start)
+	in := func(s time.Time) bool {
+		return !t.Before(s) && t.Before(s.Add(duration))
+	}
+
+	var period time.Duration
+	switch w.Recurrence {
+	case RecurrenceDaily:
+		period = 24 * time.Hour
+	case RecurrenceWeekly:
+		period = 7 * 24 * time.Hour
+	case RecurrenceMonthly:
+		t = t.UTC()
+		months := (t.Year()-start.Year())*12 + int(t.Month()) - int(start.Month())
+		//a window can run into the next month
+		return in(addMonths(start, months)) || in(addMonths(start, months-1))
+	default:
+		return in(start)
+	}
+
+	return in(start.Add(t.Sub(start) / period * period))
+}
+
+//MaintenanceSchedule is the set of MaintenanceWindows
+type MaintenanceSchedule struct {
+	windows []*MaintenanceWindow
+	mu      *sync.RWMutex
+}
+
+//NewMaintenanceSchedule returns a new, empty MaintenanceSchedule
+func NewMaintenanceSchedule() *MaintenanceSchedule {
+	return &MaintenanceSchedule{windows: make([]*MaintenanceWindow, 0), mu: new(sync.RWMutex)}
+}
+
+//Set replaces the MaintenanceWindows in the schedule
+func (s *MaintenanceSchedule) Set(windows []*MaintenanceWindow) {
+	s.mu.Lock()
+	s.windows = windows
+	s.mu.Unlock()
+}
+
+//Active returns true if d is in a MaintenanceWindow at t
+func (s *MaintenanceSchedule) Active(d *Device, t time.Time) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, w := range s.windows {
+		if w.applies(d) && w.active(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+//utc parses a time in the form 2006-01-02 15:04 in UTC
+func utc(t *testing.T, s string) time.Time {
+	t.Helper()
+	v, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+	if err != nil {
+		t.Fatalf("Unable to parse %q: %v", s, err)
+	}
+	return v
+}
+
+func TestMaintenanceWindowActive(t *testing.T) {
+	tests := []struct {
+		start      string
+		end        string
+		recurrence Recurrence
+		t          string
+		want       bool
+	}{
+		{"2026-01-10 02:00", "2026-01-10 04:00", RecurrenceNone, "2026-01-10 01:59", false},
+		{"2026-01-10 02:00", "2026-01-10 04:00", RecurrenceNone, "2026-01-10 02:00", true},
+		{"2026-01-10 02:00", "2026-01-10 04:00", RecurrenceNone, "2026-01-10 03:59", true},
+		{"2026-01-10 02:00", "2026-01-10 04:00", RecurrenceNone, "2026-01-10 04:00", false},
+		{"2026-01-10 02:00", "2026-01-10 04:00", RecurrenceNone, "2026-01-11 03:00", false},
+
+		{"2026-01-10 02:00", "2026-01-10 04:00", RecurrenceDaily, "2026-01-09 03:00", false},
+		{"2026-01-10 02:00", "2026-01-10 04:00", RecurrenceDaily, "2026-01-15 03:00", true},
+		{"2026-01-10 02:00", "2026-01-10 04:00", RecurrenceDaily, "2026-01-15 04:30", false},
+		{"2026-01-10 23:00", "2026-01-11 01:00", RecurrenceDaily, "2026-01-20 00:30", true},
+		{"2026-01-10 23:00", "2026-01-11 01:00", RecurrenceDaily, "2026-01-20 23:30", true},
+		{"2026-01-10 23:00", "2026-01-11 01:00", RecurrenceDaily, "2026-01-20 01:30", false},
+
+		{"2026-01-10 02:00", "2026-01-10 04:00", RecurrenceWeekly, "2026-01-16 03:00", false},
+		{"2026-01-10 02:00", "2026-01-10 04:00", RecurrenceWeekly, "2026-01-17 03:00", true},
+		{"2026-01-10 02:00", "2026-01-10 04:00", RecurrenceWeekly, "2026-01-24 02:00", true},
+		{"2026-01-10 02:00", "2026-01-10 04:00", RecurrenceWeekly, "2026-01-24 04:00", false},
+
+		{"2026-01-15 02:00", "2026-01-15 04:00", RecurrenceMonthly, "2026-02-15 03:00", true},
+		{"2026-01-15 02:00", "2026-01-15 04:00", RecurrenceMonthly, "2026-02-16 03:00", false},
+		{"2026-01-15 02:00", "2026-01-15 04:00", RecurrenceMonthly, "2026-02-15 01:00", false},
+		{"2026-01-15 02:00", "2026-01-15 04:00", RecurrenceMonthly, "2027-01-15 03:00", true},
+
+		//month-end starts are clamped to the last day of shorter months
+		{"2026-01-31 02:00", "2026-01-31 04:00", RecurrenceMonthly, "2026-02-28 03:00", true},
+		{"2026-01-31 02:00", "2026-01-31 04:00", RecurrenceMonthly, "2026-03-01 12:00", false},
+		{"2026-01-31 02:00", "2026-01-31 04:00", RecurrenceMonthly, "2026-03-02 12:00", false},
+		{"2026-01-31 02:00", "2026-01-31 04:00", RecurrenceMonthly, "2026-03-03 03:00", false},
+		{"2026-01-31 02:00", "2026-01-31 04:00", RecurrenceMonthly, "2026-03-31 03:00", true},
+		{"2026-01-31 02:00", "2026-01-31 04:00", RecurrenceMonthly, "2026-04-30 03:00", true},
+		{"2026-01-31 02:00", "2026-01-31 04:00", RecurrenceMonthly, "2028-02-29 03:00", true},
+		{"2026-01-30 02:00", "2026-01-30 04:00", RecurrenceMonthly, "2026-02-28 03:00", true},
+		{"2026-01-30 02:00", "2026-01-30 04:00", RecurrenceMonthly, "2026-03-30 03:00", true},
+		{"2026-01-30 02:00", "2026-01-30 04:00", RecurrenceMonthly, "2026-03-31 03:00", false},
+
+		//windows can run into the next month
+		{"2026-01-31 23:00", "2026-02-01 03:00", RecurrenceMonthly, "2026-03-01 01:00", true},
+		{"2026-01-31 23:00", "2026-02-01 03:00", RecurrenceMonthly, "2026-03-01 04:00", false},
+		{"2026-01-31 23:00", "2026-02-01 03:00", RecurrenceMonthly, "2026-04-01 02:00", true},
+	}
+
+	for _, test := range tests {
+		w := &MaintenanceWindow{Start: timestamp{utc(t, test.start)}, End: timestamp{utc(t, test.end)}, Recurrence: test.recurrence}
+		if got := w.active(utc(t, test.t)); got != test.want {
+			t.Errorf("%s window %s - %s: active(%s) = %v, want %v", test.recurrence, test.start, test.end, test.t, got, test.want)
+		}
+	}
+}
+
+func TestMaintenanceWindowActiveDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("Time zone database not available:", err)
+	}
+
+	//windows are in UTC, so they move in local time when DST starts on 2026-03-08
+	tests := []struct {
+		recurrence Recurrence
+		t          time.Time
+		want       bool
+	}{
+		{RecurrenceDaily, time.Date(2026, 3, 7, 1, 30, 0, 0, loc), true},
+		{RecurrenceDaily, time.Date(2026, 3, 10, 1, 30, 0, 0, loc), false},
+		{RecurrenceDaily, time.Date(2026, 3, 10, 2, 30, 0, 0, loc), true},
+		{RecurrenceWeekly, time.Date(2026, 3, 15, 1, 30, 0, 0, loc), false},
+		{RecurrenceWeekly, time.Date(2026, 3, 15, 2, 30, 0, 0, loc), true},
+		{RecurrenceMonthly, time.Date(2026, 4, 1, 1, 30, 0, 0, loc), false},
+		{RecurrenceMonthly, time.Date(2026, 4, 1, 2, 30, 0, 0, loc), true},
+	}
+
+	for _, test := range tests {
+		//01:00 - 02:00 EST, 02:00 - 03:00 EDT
+		w := &MaintenanceWindow{Start: timestamp{utc(t, "2026-03-01 06:00")}, End: timestamp{utc(t, "2026-03-01 07:00")}, Recurrence: test.recurrence}
+		if got := w.active(test.t); got != test.want {
+			t.Errorf("%s: active(%s) = %v, want %v", test.recurrence, test.t, got, test.want)
+		}
+	}
+}
+
+func TestMaintenanceScheduleActive(t *testing.T) {
+	window := func(deviceID, deviceTypeID *string, start string) *MaintenanceWindow {
+		s := utc(t, start)
+		return &MaintenanceWindow{DeviceID: deviceID, DeviceTypeID: deviceTypeID, Start: timestamp{s}, End: timestamp{s.Add(time.Hour)}, Recurrence: RecurrenceNone}
+	}
+
+	s := NewMaintenanceSchedule()
+	s.Set([]*MaintenanceWindow{
+		window(stringPtr("1"), nil, "2026-01-10 01:00"),
+		window(nil, stringPtr("switch"), "2026-01-10 02:00"),
+		window(nil, nil, "2026-01-10 03:00"),
+		//a Device window takes precedence over its type
+		window(stringPtr("3"), stringPtr("router"), "2026-01-10 04:00"),
+	})
+
+	router := testDevice("1", "router")
+	router.DeviceType = &DeviceType{ID: "router", Name: "Router"}
+	sw := testDevice("2", "switch")
+	sw.DeviceType = &DeviceType{ID: "switch", Name: "Switch"}
+	untyped := testDevice("3", "printer")
+
+	tests := []struct {
+		device *Device
+		t      string
+		want   bool
+	}{
+		{router, "2026-01-10 01:30", true},
+		{sw, "2026-01-10 01:30", false},
+		{untyped, "2026-01-10 01:30", false},
+		{router, "2026-01-10 02:30", false},
+		{sw, "2026-01-10 02:30", true},
+		{untyped, "2026-01-10 02:30", false},
+		{router, "2026-01-10 03:30", true},
+		{sw, "2026-01-10 03:30", true},
+		{untyped, "2026-01-10 03:30", true},
+		{router, "2026-01-10 04:30", false},
+		{untyped, "2026-01-10 04:30", true},
+		{router, "2026-01-10 05:30", false},
+	}
+
+	for _, test := range tests {
+		if got := s.Active(test.device, utc(t, test.t)); got != test.want {
+			t.Errorf("%s at %s: active = %v, want %v", test.device.Hostname, test.t, got, test.want)
+		}
+	}
+}
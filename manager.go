@@ -1,53 +1,246 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 )
 
+//DeviceSettings are optional ping settings for a Device or DeviceType. Unset settings are inherited from the
+//DeviceType, then the global configuration
+type DeviceSettings struct {
+	PingInterval *int  `json:"ping_interval"` // in seconds
+	PingTimeout  *int  `json:"ping_timeout"`  // in milliseconds
+	PingCount    *int  `json:"ping_count"`
+	PingEnabled  *bool `json:"ping_enabled"`
+}
+
+type DeviceType struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	DeviceSettings
+}
+
+//ProbeSettings are the effective settings used to ping a Device
+type ProbeSettings struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	Count    int
+	Enabled  bool
+}
+
 type Device struct {
 	ID       string `json:"id"`
 	Hostname string `json:"hostname"`
+	DeviceSettings
+	DeviceType     *DeviceType `json:"device_type"`
+	ParentDeviceID *string     `json:"parent_device_id"`
+	//StaticIPs are always pinged, along with Hostname's IPs unless NoDNS is set
+	StaticIPs deviceIPs `json:"static_ips"`
+	//NoDNS disables resolving Hostname. If the Device has no StaticIPs, Hostname is used if it's an IP address
+	NoDNS bool `json:"no_dns"`
+	//Nameservers is a comma-separated list of nameservers used to resolve Hostname instead of the default
+	Nameservers *string `json:"nameservers"`
+	//Subnet makes the Device a subnet sweep: every address in the subnet is pinged to discover live hosts
+	Subnet *string `json:"subnet"`
+
+	ips   []net.IP
+	probe ProbeSettings
+	mu    *sync.RWMutex
+}
+
+//snapshot returns a copy of the Device. Pings are sent with a snapshot so their results (and the Events and Alerts
+//built from them) can be read without holding d.mu while the Device is updated. d.mu must be held
+func (d *Device) snapshot() *Device {
+	s := *d
+	s.ips = make([]net.IP, len(d.ips))
+	copy(s.ips, d.ips)
+	s.mu = new(sync.RWMutex)
+	return &s
+}
+
+//probeSettings returns the effective ProbeSettings for the Device
+func (d *Device) probeSettings(defaults ProbeSettings) ProbeSettings {
+	s := defaults
+	layers := []*DeviceSettings{}
+	if d.DeviceType != nil {
+		layers = append(layers, &d.DeviceType.DeviceSettings)
+	}
+	layers = append(layers, &d.DeviceSettings)
+
+	for _, l := range layers {
+		if l.PingInterval != nil {
+			s.Interval = time.Second * time.Duration(*l.PingInterval)
+		}
+		if l.PingTimeout != nil {
+			s.Timeout = time.Millisecond * time.Duration(*l.PingTimeout)
+		}
+		if l.PingCount != nil {
+			s.Count = *l.PingCount
+		}
+		if l.PingEnabled != nil {
+			s.Enabled = *l.PingEnabled
+		}
+	}
+	return s
+}
+
+//deviceIPs are a Device's static IPs
+type deviceIPs []net.IP
+
+//UnmarshalJSON unmarshals the device_ip rows of a Device
+func (ips *deviceIPs) UnmarshalJSON(b []byte) error {
+	var rows []struct {
+		IP string `json:"ip"`
+	}
+	if err := json.Unmarshal(b, &rows); err != nil {
+		return err
+	}
+
+	*ips = make(deviceIPs, 0, len(rows))
+	for _, r := range rows {
+		ip := parseIP(r.IP)
+		if ip == nil {
+			return fmt.Errorf("Invalid IP: %s", r.IP)
+		}
+		*ips = append(*ips, ip)
+	}
+	return nil
+}
 
-	ips []net.IP
-	mu  *sync.RWMutex
+//fixedIPs returns the IPs d is pinged at without resolving Hostname
+func (d *Device) fixedIPs() []net.IP {
+	ips := make([]net.IP, len(d.StaticIPs))
+	copy(ips, d.StaticIPs)
+	if d.NoDNS && len(ips) == 0 {
+		if ip := parseIP(d.Hostname); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+//stringsEqual returns true if a and b are both nil or point to equal strings
+func stringsEqual(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+//staticIPsEqual returns true if a and b contain the same IPs in the same order
+func staticIPsEqual(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
 }
 
+//Scheduler resolution. The wheel covers schedulerTick * schedulerSlots before wrapping
+const (
+	schedulerTick  = 10 * time.Millisecond
+	schedulerSlots = 1024
+)
+
 type Manager struct {
 	r *ResolverService
 	p *PingService
+	//g is nil if GraphQL isn't configured
 	g *GraphQLService
+	s *Scheduler
+	t *StateTracker
+	n *NotifyService
+	w *MaintenanceSchedule
+	x *Metrics
+	q *Spool
+
+	defaults ProbeSettings
 
 	devices map[string]*Device
+	synced  bool
 	devMu   *sync.RWMutex
 
-	buf   []*Ping
-	bufMu *sync.Mutex
+	sweeps *SweepTracker
+	//sweepMax is the maximum number of addresses in a subnet sweep
+	sweepMax int
+
+	healthTimeout time.Duration
+
+	sinks []*sinkWriter
 }
 
 func (m *Manager) syncer(devices []*Device) {
 	m.devMu.Lock()
 	for _, dNew := range devices {
-		if dOld, ok := m.devices[dNew.ID]; ok && dNew.Hostname != dOld.Hostname {
-			dOld.mu.Lock()
+		probe := dNew.probeSettings(m.defaults)
+
+		//subnet sweeps ping every address in the subnet instead of resolving their hostname
+		if dNew.Subnet != nil {
+			ips, err := expandSubnet(*dNew.Subnet, m.sweepMax)
+			if err != nil {
+				log.Printf("Manager: Unable to expand subnet for %s: %v\n", dNew.Hostname, err)
+			}
+			dNew.StaticIPs, dNew.NoDNS = ips, true
+		}
+
+		dOld, ok := m.devices[dNew.ID]
+		if !ok {
+			d := &Device{
+				ID:             dNew.ID,
+				Hostname:       dNew.Hostname,
+				DeviceSettings: dNew.DeviceSettings,
+				DeviceType:     dNew.DeviceType,
+				ParentDeviceID: dNew.ParentDeviceID,
+				StaticIPs:      dNew.StaticIPs,
+				NoDNS:          dNew.NoDNS,
+				Subnet:         dNew.Subnet,
+				Nameservers:    dNew.Nameservers,
+				ips:            make([]net.IP, 0),
+				probe:          probe,
+				mu:             new(sync.RWMutex),
+			}
+			m.devices[d.ID] = d
+			m.resolve(d)
+			m.schedule(d)
+			continue
+		}
+
+		dOld.mu.Lock()
+		hostnameChanged := dNew.Hostname != dOld.Hostname || dNew.NoDNS != dOld.NoDNS ||
+			!staticIPsEqual(dNew.StaticIPs, dOld.StaticIPs) || !stringsEqual(dNew.Nameservers, dOld.Nameservers)
+		if hostnameChanged {
 			dOld.Hostname = dNew.Hostname
+			dOld.StaticIPs = dNew.StaticIPs
+			dOld.NoDNS = dNew.NoDNS
+			dOld.Nameservers = dNew.Nameservers
 			dOld.ips = make([]net.IP, 0)
-			dOld.mu.Unlock()
-			m.r.Resolve(dOld)
-		} else {
-			m.devices[dNew.ID] = &Device{
-				ID:       dNew.ID,
-				Hostname: dNew.Hostname,
-				ips:      make([]net.IP, 0),
-				mu:       new(sync.RWMutex),
-			}
-			m.r.Resolve(m.devices[dNew.ID])
+		}
+		dOld.Subnet = dNew.Subnet
+		dOld.DeviceSettings = dNew.DeviceSettings
+		dOld.DeviceType = dNew.DeviceType
+		dOld.ParentDeviceID = dNew.ParentDeviceID
+		probeChanged := dOld.probe != probe
+		dOld.probe = probe
+		dOld.mu.Unlock()
+
+		if hostnameChanged {
+			m.resolve(dOld)
+		}
+		if probeChanged {
+			m.schedule(dOld)
 		}
 	}
 
+	removed := make([]string, 0)
 outer:
 	for _, dOld := range m.devices {
 		for _, dNew := range devices {
@@ -55,63 +248,159 @@ outer:
 				continue outer
 			}
 		}
+		removed = append(removed, dOld.ID)
 		delete(m.devices, dOld.ID)
 	}
 
+	m.synced = true
 	m.devMu.Unlock()
 
+	//removed Devices are forgotten after devMu is released so other locks are never taken while holding it
+	for _, id := range removed {
+		m.s.Remove(id)
+		m.t.Remove(id)
+		m.x.Remove(id)
+		m.sweeps.Remove(id)
+	}
+
 	log.Println("Manager: synced", len(devices), "Devices")
 }
 
-func (m *Manager) resolver(interval time.Duration) {
-	for {
-		time.Sleep(interval)
-		m.devMu.RLock()
-		for _, d := range m.devices {
-			m.r.Resolve(d)
+func (m *Manager) maintenance(windows []*MaintenanceWindow) {
+	m.w.Set(windows)
+	log.Println("Manager: synced", len(windows), "MaintenanceWindows")
+}
+
+//resolve populates d's IPs directly if it has NoDNS set or hasn't been resolved yet, then resolves its Hostname
+func (m *Manager) resolve(d *Device) {
+	d.mu.Lock()
+	if d.NoDNS || len(d.ips) == 0 {
+		d.ips = d.fixedIPs()
+	}
+	if d.NoDNS && len(d.ips) == 0 {
+		log.Printf("Manager: %s has no_dns set but no static IPs\n", d.Hostname)
+	}
+	d.mu.Unlock()
+
+	m.r.Resolve(d)
+}
+
+//resolving returns the number of Devices that are resolved with DNS
+func (m *Manager) resolving() int {
+	m.devMu.RLock()
+	defer m.devMu.RUnlock()
+	n := 0
+	for _, d := range m.devices {
+		d.mu.RLock()
+		if !d.NoDNS {
+			n++
 		}
-		m.devMu.RUnlock()
+		d.mu.RUnlock()
 	}
+	return n
 }
 
-func (m *Manager) pinger(interval time.Duration) {
+func (m *Manager) resolver(interval time.Duration) {
 	for {
 		time.Sleep(interval)
 		m.devMu.RLock()
 		for _, d := range m.devices {
-			if len(d.ips) > 0 {
-				m.p.Ping(d)
-			}
+			m.resolve(d)
 		}
 		m.devMu.RUnlock()
 	}
 }
 
+//schedule starts pinging d at its interval if it's enabled, or stops pinging it otherwise
+func (m *Manager) schedule(d *Device) {
+	if !d.probe.Enabled {
+		m.s.Remove(d.ID)
+		return
+	}
+	if err := m.s.Add(d, d.probe.Interval); err != nil {
+		log.Printf("Manager: Unable to schedule %s: %v\n", d.Hostname, err)
+	}
+}
+
+//fire pings d if it has any IPs
+func (m *Manager) fire(d *Device) {
+	d.mu.RLock()
+	n := len(d.ips)
+	d.mu.RUnlock()
+	if n > 0 {
+		m.p.Ping(d)
+	}
+}
+
 func (m *Manager) buffer(e *Ping) {
-	m.bufMu.Lock()
-	m.buf = append(m.buf, e)
-	m.bufMu.Unlock()
+	//subnet sweeps only track live hosts
+	e.Device.mu.RLock()
+	sweep := e.Device.Subnet != nil
+	e.Device.mu.RUnlock()
+	if sweep {
+		m.sweeps.Update(e)
+		return
+	}
+
+	//results during a maintenance window are stored as planned and don't send Alerts
+	e.Planned = m.w.Active(e.Device, e.SentTime)
+
+	events := m.t.Update(e)
+	for _, ev := range events {
+		ev.Planned = e.Planned
+		ip := "*"
+		if ev.IP != nil {
+			ip = ev.IP.String()
+		}
+		log.Printf("Manager: %s (%s) changed from %s to %s (flapping: %v, planned: %v)\n", ev.Device.Hostname, ip, ev.PreviousState, ev.State, ev.Flapping, ev.Planned)
+		if !ev.Planned {
+			m.n.HandleEvent(ev)
+		}
+	}
+	if !e.Planned {
+		m.n.HandlePing(e)
+	}
+	m.x.ObservePing(e)
+
+	for _, w := range m.sinks {
+		w.b.Add(e, events)
+	}
 }
 
-func (m *Manager) writer(interval time.Duration) {
+//discoverer records the host changes of subnet sweeps in the discovered_host table and sends Alerts every interval
+func (m *Manager) discoverer(interval time.Duration) {
 	for {
 		time.Sleep(interval)
+		for _, r := range m.sweeps.Take() {
+			var live, lost, appeared, disappeared []net.IP
+			for _, c := range r.Changes {
+				if c.Live {
+					live = append(live, c.IP)
+				} else {
+					lost = append(lost, c.IP)
+				}
+				if c.Alert && c.Live {
+					appeared = append(appeared, c.IP)
+				} else if c.Alert {
+					disappeared = append(disappeared, c.IP)
+				}
+			}
 
-		m.bufMu.Lock()
-		if len(m.buf) == 0 {
-			m.bufMu.Unlock()
-			continue
-		}
-		buf := make([]*Ping, len(m.buf))
-		copy(buf, m.buf)
-		m.buf = make([]*Ping, 0)
-		m.bufMu.Unlock()
+			now := time.Now()
+			if m.g != nil {
+				if err := m.g.UpdateDiscoveredHosts(r.Device.ID, live, lost, now); err != nil {
+					log.Printf("Manager: Unable to update discovered hosts for %s: %v\n", r.Device.Hostname, err)
+				}
+			}
 
-		go func(b []*Ping) {
-			if err := m.g.InsertPings(b); err != nil {
-				log.Println("Manager: Failed to insert Pings:", err)
+			if len(appeared) == 0 && len(disappeared) == 0 {
+				continue
+			}
+			log.Printf("Manager: %s live hosts changed (appeared: %v, disappeared: %v)\n", r.Device.Hostname, appeared, disappeared)
+			if !m.w.Active(r.Device, now) {
+				m.n.HandleHosts(r.Device, appeared, disappeared, now)
 			}
-		}(buf)
+		}
 	}
 }
 
@@ -125,36 +414,217 @@ func (m *Manager) purger(interval, olderThan time.Duration) {
 	}
 }
 
+//metrics registers the Manager's internal metrics
+func (m *Manager) metrics() {
+	m.x.Gauge("net_monitor_devices", "Devices being monitored.", func() float64 {
+		m.devMu.RLock()
+		defer m.devMu.RUnlock()
+		return float64(len(m.devices))
+	})
+	m.x.Gauge("net_monitor_pending_probes", "Echo Requests waiting for a reply.", func() float64 {
+		return float64(m.p.Pending())
+	})
+	m.x.Gauge("net_monitor_scheduler_lag_seconds", "Maximum scheduling lag since the last scrape.", func() float64 {
+		_, max := m.s.Lag()
+		return max.Seconds()
+	})
+	if m.q != nil {
+		m.x.Gauge("net_monitor_spool_bytes", "Bytes waiting to be replayed from the spool.", func() float64 {
+			return float64(m.q.Size())
+		})
+		m.x.Counter("net_monitor_spool_evicted_bytes_total", "Bytes evicted from the spool before they were replayed.", func() float64 {
+			return float64(m.q.Evicted())
+		})
+	}
+	m.x.Counter("net_monitor_resolver_failures_total", "Failed DNS lookups.", func() float64 {
+		return float64(m.r.Failures())
+	})
+	if m.g != nil {
+		m.x.Counter("net_monitor_graphql_reconnects_total", "GraphQL reconnection attempts.", func() float64 {
+			return float64(m.g.Reconnects())
+		})
+	}
+}
+
+//Handler returns the Manager's HTTP handler
+func (m *Manager) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.x)
+	mux.Handle("/healthz", healthHandler(m.healthy))
+	mux.Handle("/readyz", healthHandler(m.ready))
+	return mux
+}
+
 func NewManager(c *config) (*Manager, error) {
-	r := NewResolverService(c.DNSWorkers)
+	if c.PingInterval < 1 {
+		return nil, fmt.Errorf("Invalid PingInterval: %d", c.PingInterval)
+	}
+	if c.PingTimeout < 1 {
+		return nil, fmt.Errorf("Invalid PingTimeout: %d", c.PingTimeout)
+	}
+	if c.PingCount < 1 {
+		return nil, fmt.Errorf("Invalid PingCount: %d", c.PingCount)
+	}
+	if OverflowPolicy(c.WriteOverflow) == OverflowSpool && c.SpoolDir == "" {
+		return nil, fmt.Errorf("WriteOverflow %s requires SpoolDir", c.WriteOverflow)
+	}
 
-	p, err := NewPingService(c.PingWorkers, c.PingBufferSize, time.Millisecond*time.Duration(c.PingTimeout))
+	r, err := NewResolverService(c.DNSWorkers, c.DNSServers, c.DNSProtocol, time.Millisecond*time.Duration(c.DNSTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create ResolverService: %v", err)
+	}
+
+	p, err := NewPingService(c.PingWorkers, c.PingBufferSize, time.Millisecond*time.Duration(c.PingTimeout), SocketMode(c.PingSocketMode), c.PingIdentifiers, time.Millisecond*time.Duration(c.PingSpacing), c.SweepRate)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to create PingService: %v", err)
 	}
 
-	g, err := NewGraphQLService(c.GraphQLEndpoint, c.GraphQLAPISecret)
+	notifiers := make([]Notifier, 0)
+	for _, spec := range c.Webhooks {
+		w, err := NewWebhookNotifier(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create WebhookNotifier: %v", err)
+		}
+		notifiers = append(notifiers, w)
+	}
+
+	if c.SMTPHost != "" {
+		s, err := NewSMTPNotifier(c.SMTPHost, c.SMTPPort, c.SMTPUsername, c.SMTPPassword, c.SMTPFrom, c.SMTPStartTLS,
+			c.SMTPRecipients, c.SMTPCriticalTypes, time.Minute*time.Duration(c.SMTPDigestInterval),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create SMTPNotifier: %v", err)
+		}
+		notifiers = append(notifiers, s)
+	}
+
+	n, err := NewNotifyService(notifiers,
+		&AlertThresholds{Loss: float64(c.AlertLoss), RTT: time.Millisecond * time.Duration(c.AlertRTT)},
+		c.AlertTemplate, time.Minute*time.Duration(c.AlertDedupWindow), c.AlertRetries, c.PingBufferSize, c.AlertUnreachable,
+	)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to create GraphQLService: %v", err)
+		return nil, fmt.Errorf("Unable to create NotifyService: %v", err)
+	}
+
+	var q *Spool
+	if c.SpoolDir != "" {
+		if q, err = OpenSpool(c.SpoolDir, int64(c.SpoolSegmentSize)<<20, int64(c.SpoolMaxSize)<<20); err != nil {
+			return nil, fmt.Errorf("Unable to open Spool: %v", err)
+		}
+	}
+
+	var g *GraphQLService
+	if c.GraphQLEndpoint != "" {
+		if g, err = NewGraphQLService(c.GraphQLEndpoint, c.GraphQLAPISecret); err != nil {
+			return nil, fmt.Errorf("Unable to create GraphQLService: %v", err)
+		}
+	}
+
+	var source DeviceSource
+	switch c.DeviceSource {
+	case "graphql":
+		if g == nil {
+			return nil, fmt.Errorf("DeviceSource %s requires GraphQLEndpoint", c.DeviceSource)
+		}
+		source = g
+	case "file":
+		if source, err = NewFileDeviceSource(c.DeviceFile, time.Second*time.Duration(c.DeviceFileInterval)); err != nil {
+			return nil, fmt.Errorf("Unable to create FileDeviceSource: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown DeviceSource: %s", c.DeviceSource)
 	}
 
 	m := &Manager{
-		r: r, p: p, g: g,
+		r: r, p: p, g: g, n: n, q: q,
+		w: NewMaintenanceSchedule(),
+		x: NewMetrics(),
+		defaults: ProbeSettings{
+			Interval: time.Second * time.Duration(c.PingInterval),
+			Timeout:  time.Millisecond * time.Duration(c.PingTimeout),
+			Count:    c.PingCount,
+			Enabled:  true,
+		},
 		devices: make(map[string]*Device),
 		devMu:   new(sync.RWMutex),
-		buf:     make([]*Ping, 0),
-		bufMu:   new(sync.Mutex),
+
+		sweeps:   NewSweepTracker(c.StateFailThreshold),
+		sweepMax: c.SweepMaxHosts,
+
+		healthTimeout: time.Minute * time.Duration(c.HealthTimeout),
+
+		sinks: make([]*sinkWriter, 0),
 	}
 
-	if err = g.SubscribeDevices(m.syncer); err != nil {
+	interval := time.Second * time.Duration(c.PingInterval)
+	for _, name := range c.Sinks {
+		batch := c.WriteBatchSize
+		if b, ok := c.SinkBatchSizes[name]; ok {
+			batch = b
+		}
+
+		var sink ResultSink
+		switch name {
+		case "graphql":
+			if g == nil {
+				return nil, fmt.Errorf("graphql sink requires GraphQLEndpoint")
+			}
+			sink = NewGraphQLSink(g, q, batch, interval)
+		case "postgres":
+			if sink, err = NewPostgresSink(c.PostgresURL); err != nil {
+				return nil, fmt.Errorf("Unable to create PostgresSink: %v", err)
+			}
+		case "influxdb":
+			if sink, err = NewInfluxSink(c.InfluxURL, c.InfluxOrg, c.InfluxBucket, c.InfluxToken, c.InfluxMeasurement, c.InfluxTags); err != nil {
+				return nil, fmt.Errorf("Unable to create InfluxSink: %v", err)
+			}
+		case "file":
+			if sink, err = NewFileSink(c.FilePath, FileFormat(c.FileFormat), int64(c.FileMaxSize)*1024*1024, c.FileMaxBackups); err != nil {
+				return nil, fmt.Errorf("Unable to create FileSink: %v", err)
+			}
+		case "prometheus":
+			if sink, err = NewPrometheusSink(c.PrometheusURL, c.PrometheusHeaders, c.PrometheusRetries); err != nil {
+				return nil, fmt.Errorf("Unable to create PrometheusSink: %v", err)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown sink: %s", name)
+		}
+
+		w, err := newSinkWriter(sink, m.x, interval, batch, c.WriteBufferSize, c.WriteConcurrency, OverflowPolicy(c.WriteOverflow))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create writer for %s: %v", name, err)
+		}
+		m.sinks = append(m.sinks, w)
+	}
+
+	m.s = NewScheduler(schedulerTick, schedulerSlots, m.fire)
+	m.t = NewStateTracker(&StateThresholds{
+		Fail:         c.StateFailThreshold,
+		Recover:      c.StateRecoverThreshold,
+		DegradedLoss: float64(c.StateDegradedLoss),
+		DegradedRTT:  time.Millisecond * time.Duration(c.StateDegradedRTT),
+		FlapWindow:   time.Minute * time.Duration(c.StateFlapWindow),
+		FlapCount:    c.StateFlapCount,
+	})
+
+	if err = source.SubscribeDevices(m.syncer); err != nil {
 		return nil, fmt.Errorf("Unable to Subscribe to Devices: %v", err)
 	}
 
+	if g != nil {
+		if err = g.SubscribeMaintenance(m.maintenance); err != nil {
+			return nil, fmt.Errorf("Unable to Subscribe to MaintenanceWindows: %v", err)
+		}
+	}
+
+	m.metrics()
+
 	p.SetListener(m.buffer)
-	go m.pinger(time.Second * time.Duration(c.PingInterval))
-	go m.writer(time.Second * time.Duration(c.PingInterval))
-	go m.purger(time.Minute*time.Duration(c.PurgeInterval), time.Minute*time.Duration(c.PurgeOlderThan))
+	if g != nil {
+		go m.purger(time.Minute*time.Duration(c.PurgeInterval), time.Minute*time.Duration(c.PurgeOlderThan))
+	}
 	go m.resolver(time.Minute * time.Duration(c.DNSLookupInterval))
+	go m.discoverer(interval)
 
 	log.Println("Manager: Successfully started")
 
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Histogram buckets, in seconds
+var (
+	rttBuckets   = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+	writeBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+//histogram is a cumulative Prometheus histogram
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+//write writes the histogram's series in the text exposition format. labels are rendered without braces
+func (h *histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, formatFloat(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(labels), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braces(labels), h.count)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+//label renders a label pair with its value escaped
+func label(name, value string) string {
+	return name + `="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+//ipMetrics are the metrics for a single Device IP
+type ipMetrics struct {
+	hostname string
+	rtt      *histogram
+	sent     uint64
+	lost     uint64
+}
+
+//Metrics collects Prometheus metrics for Ping results and the pinger's internals
+type Metrics struct {
+	ips map[string]map[string]*ipMetrics
+
+	//writes and writeFailures are by sink name
+	writes        map[string]*histogram
+	writeFailures map[string]uint64
+
+	gauges   []*gauge
+	counters []*gauge
+
+	mu *sync.Mutex
+}
+
+//gauge is a metric whose value is read when scraped
+type gauge struct {
+	name   string
+	help   string
+	labels string
+	value  func() float64
+}
+
+//NewMetrics returns a new Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		ips:           make(map[string]map[string]*ipMetrics),
+		writes:        make(map[string]*histogram),
+		writeFailures: make(map[string]uint64),
+		mu:            new(sync.Mutex),
+	}
+}
+
+//newGauge returns a new gauge. labels are label name and value pairs
+func newGauge(name, help string, f func() float64, labels []string) *gauge {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, label(labels[i], labels[i+1]))
+	}
+	return &gauge{name: name, help: help, labels: strings.Join(pairs, ","), value: f}
+}
+
+//Gauge registers a gauge read from f when scraped. labels are label name and value pairs
+func (m *Metrics) Gauge(name, help string, f func() float64, labels ...string) {
+	m.mu.Lock()
+	m.gauges = append(m.gauges, newGauge(name, help, f, labels))
+	m.mu.Unlock()
+}
+
+//Counter registers a counter read from f when scraped. labels are label name and value pairs
+func (m *Metrics) Counter(name, help string, f func() float64, labels ...string) {
+	m.mu.Lock()
+	m.counters = append(m.counters, newGauge(name, help, f, labels))
+	m.mu.Unlock()
+}
+
+//ObservePing records the RTTs and loss of p. Series for IPs the Device no longer resolves to are dropped
+func (m *Metrics) ObservePing(p *Ping) {
+	p.Device.mu.RLock()
+	hostname := p.Device.Hostname
+	current := make(map[string]struct{}, len(p.Device.ips))
+	for _, ip := range p.Device.ips {
+		current[ip.String()] = struct{}{}
+	}
+	p.Device.mu.RUnlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ips, ok := m.ips[p.Device.ID]
+	if !ok {
+		ips = make(map[string]*ipMetrics)
+		m.ips[p.Device.ID] = ips
+	}
+
+	//forget IPs the Device no longer resolves to
+	for addr := range ips {
+		if _, ok := current[addr]; !ok {
+			delete(ips, addr)
+		}
+	}
+
+	ip, ok := ips[p.IP.String()]
+	if !ok {
+		ip = &ipMetrics{rtt: newHistogram(rttBuckets)}
+		ips[p.IP.String()] = ip
+	}
+
+	ip.hostname = hostname
+	ip.sent += uint64(p.Sent)
+	ip.lost += uint64(p.Sent - p.Received)
+	for _, probe := range p.Probes {
+		if rtt, ok := probe.RTT(); ok {
+			ip.rtt.observe(rtt.Seconds())
+		}
+	}
+}
+
+//ObserveWrite records the latency and result of a write to the named sink
+func (m *Metrics) ObserveWrite(sink string, d time.Duration, err error) {
+	m.mu.Lock()
+	h, ok := m.writes[sink]
+	if !ok {
+		h = newHistogram(writeBuckets)
+		m.writes[sink] = h
+	}
+	h.observe(d.Seconds())
+	if err != nil {
+		m.writeFailures[sink]++
+	}
+	m.mu.Unlock()
+}
+
+//Remove forgets the metrics for the Device with the given id
+func (m *Metrics) Remove(id string) {
+	m.mu.Lock()
+	delete(m.ips, id)
+	m.mu.Unlock()
+}
+
+//write writes all metrics in the Prometheus text exposition format. Collected metrics are rendered and the gauges
+//are copied under mu, but gauge functions are called after it's released, since they may take other locks that are
+//held while calling into Metrics
+func (m *Metrics) write(w io.Writer) {
+	buf := new(bytes.Buffer)
+	m.mu.Lock()
+	m.writeCollected(buf)
+	gauges := make([]*gauge, len(m.gauges))
+	copy(gauges, m.gauges)
+	counters := make([]*gauge, len(m.counters))
+	copy(counters, m.counters)
+	m.mu.Unlock()
+
+	w.Write(buf.Bytes())
+
+	for _, typ := range []string{"gauge", "counter"} {
+		metrics := gauges
+		if typ == "counter" {
+			metrics = counters
+		}
+
+		//series with the same name are written together, in the order their name was first registered
+		names := make([]string, 0)
+		byName := make(map[string][]*gauge)
+		for _, g := range metrics {
+			if _, ok := byName[g.name]; !ok {
+				names = append(names, g.name)
+			}
+			byName[g.name] = append(byName[g.name], g)
+		}
+
+		for _, name := range names {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, byName[name][0].help)
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+			for _, g := range byName[name] {
+				fmt.Fprintf(w, "%s%s %s\n", name, braces(g.labels), formatFloat(g.value()))
+			}
+		}
+	}
+}
+
+//writeCollected writes the Ping and write metrics. m.mu must be held
+func (m *Metrics) writeCollected(w io.Writer) {
+	type series struct {
+		labels string
+		ip     *ipMetrics
+	}
+	all := make([]*series, 0)
+	for id, ips := range m.ips {
+		for addr, ip := range ips {
+			all = append(all, &series{labels: strings.Join([]string{label("device_id", id), label("hostname", ip.hostname), label("ip", addr)}, ","), ip: ip})
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].labels < all[j].labels })
+
+	fmt.Fprintln(w, "# HELP net_monitor_ping_rtt_seconds Round trip time of replies.")
+	fmt.Fprintln(w, "# TYPE net_monitor_ping_rtt_seconds histogram")
+	for _, s := range all {
+		s.ip.rtt.write(w, "net_monitor_ping_rtt_seconds", s.labels)
+	}
+
+	fmt.Fprintln(w, "# HELP net_monitor_ping_probes_sent_total Echo Requests sent.")
+	fmt.Fprintln(w, "# TYPE net_monitor_ping_probes_sent_total counter")
+	for _, s := range all {
+		fmt.Fprintf(w, "net_monitor_ping_probes_sent_total{%s} %d\n", s.labels, s.ip.sent)
+	}
+
+	fmt.Fprintln(w, "# HELP net_monitor_ping_probes_lost_total Echo Requests without a reply.")
+	fmt.Fprintln(w, "# TYPE net_monitor_ping_probes_lost_total counter")
+	for _, s := range all {
+		fmt.Fprintf(w, "net_monitor_ping_probes_lost_total{%s} %d\n", s.labels, s.ip.lost)
+	}
+
+	sinks := make([]string, 0, len(m.writes))
+	for sink := range m.writes {
+		sinks = append(sinks, sink)
+	}
+	sort.Strings(sinks)
+
+	fmt.Fprintln(w, "# HELP net_monitor_write_duration_seconds Latency of Ping writes.")
+	fmt.Fprintln(w, "# TYPE net_monitor_write_duration_seconds histogram")
+	for _, sink := range sinks {
+		m.writes[sink].write(w, "net_monitor_write_duration_seconds", label("sink", sink))
+	}
+
+	fmt.Fprintln(w, "# HELP net_monitor_write_failures_total Failed Ping writes.")
+	fmt.Fprintln(w, "# TYPE net_monitor_write_failures_total counter")
+	for _, sink := range sinks {
+		fmt.Fprintf(w, "net_monitor_write_failures_total{%s} %d\n", label("sink", sink), m.writeFailures[sink])
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	b := bufio.NewWriter(w)
+	m.write(b)
+	b.Flush()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//metricsPing returns a Ping of d at ip with a Probe for each RTT, or a lost Probe for each zero RTT
+func metricsPing(d *Device, ip string, rtts ...time.Duration) *Ping {
+	p := &Ping{Device: d, IP: net.ParseIP(ip), Sent: len(rtts)}
+	for _, rtt := range rtts {
+		probe := &Probe{SentTime: time.Unix(0, 0)}
+		if rtt > 0 {
+			recv := probe.SentTime.Add(rtt)
+			probe.RecvTime = &recv
+			p.Received++
+		}
+		p.Probes = append(p.Probes, probe)
+	}
+	return p
+}
+
+//scrape returns the response of m's handler
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %s, want the text exposition format", ct)
+	}
+	return w.Body.String()
+}
+
+func TestMetricsObservePing(t *testing.T) {
+	m := NewMetrics()
+	d := testDevice("1", `router "a"`)
+	d.ips = []net.IP{net.ParseIP("192.0.2.1")}
+
+	m.ObservePing(metricsPing(d, "192.0.2.1", 2*time.Millisecond, 0, 20*time.Millisecond))
+	m.ObservePing(metricsPing(d, "192.0.2.1", 0))
+	m.ObserveWrite("graphql", 30*time.Millisecond, nil)
+	m.ObserveWrite("graphql", 2*time.Second, errors.New("failed"))
+	m.Gauge("net_monitor_test", "Test gauge.", func() float64 { return 1.5 }, "family", "ipv4")
+	m.Counter("net_monitor_test_total", "Test counter.", func() float64 { return 3 })
+
+	body := scrape(t, m)
+	labels := `device_id="1",hostname="router \"a\"",ip="192.0.2.1"`
+	for _, want := range []string{
+		"# TYPE net_monitor_ping_rtt_seconds histogram\n",
+		`net_monitor_ping_rtt_seconds_bucket{` + labels + `,le="0.001"} 0` + "\n",
+		`net_monitor_ping_rtt_seconds_bucket{` + labels + `,le="0.0025"} 1` + "\n",
+		`net_monitor_ping_rtt_seconds_bucket{` + labels + `,le="0.025"} 2` + "\n",
+		`net_monitor_ping_rtt_seconds_bucket{` + labels + `,le="+Inf"} 2` + "\n",
+		`net_monitor_ping_rtt_seconds_sum{` + labels + `} 0.022` + "\n",
+		`net_monitor_ping_rtt_seconds_count{` + labels + `} 2` + "\n",
+		`net_monitor_ping_probes_sent_total{` + labels + `} 4` + "\n",
+		`net_monitor_ping_probes_lost_total{` + labels + `} 2` + "\n",
+		`net_monitor_write_duration_seconds_count{sink="graphql"} 2` + "\n",
+		`net_monitor_write_failures_total{sink="graphql"} 1` + "\n",
+		"# TYPE net_monitor_test gauge\nnet_monitor_test{family=\"ipv4\"} 1.5\n",
+		"# TYPE net_monitor_test_total counter\nnet_monitor_test_total 3\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsIPs(t *testing.T) {
+	m := NewMetrics()
+	a, b := testDevice("a", "a"), testDevice("b", "b")
+	a.ips = []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}
+	b.ips = []net.IP{net.ParseIP("192.0.2.3")}
+
+	m.ObservePing(metricsPing(a, "192.0.2.1", time.Millisecond))
+	m.ObservePing(metricsPing(a, "192.0.2.2", time.Millisecond))
+	m.ObservePing(metricsPing(b, "192.0.2.3", time.Millisecond))
+
+	//series are dropped for IPs a Device no longer resolves to, and for removed Devices
+	a.ips = []net.IP{net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::1")}
+	m.ObservePing(metricsPing(a, "2001:db8::1", time.Millisecond))
+	m.Remove("b")
+
+	body := scrape(t, m)
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.1", false},
+		{"192.0.2.2", true},
+		{"2001:db8::1", true},
+		{"192.0.2.3", false},
+	}
+	for _, test := range tests {
+		if got := strings.Contains(body, `ip="`+test.ip+`"`); got != test.want {
+			t.Errorf("%s: series = %v, want %v", test.ip, got, test.want)
+		}
+	}
+}
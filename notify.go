@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"text/template"
+	"time"
+)
+
+//AlertKind is the reason for an Alert
+type AlertKind string
+
+//Alert kinds
+const (
+	AlertDown      AlertKind = "down"
+	AlertRecovered AlertKind = "recovered"
+	//AlertUnreachable is sent when a Device is down because its parent is down
+	AlertUnreachable AlertKind = "unreachable"
+	AlertThreshold   AlertKind = "threshold"
+	//AlertHosts is sent when the live hosts of a subnet sweep change
+	AlertHosts AlertKind = "hosts"
+)
+
+//DefaultAlertTemplate is used to render Alert messages if no template is configured
+const DefaultAlertTemplate = `{{.Device.Hostname}}{{if .IP}} ({{.IP}}){{end}} {{if eq .Kind "threshold"}}exceeded thresholds: {{printf "%.1f" .Loss}}% loss, {{.AvgRTT}} average RTT{{else if eq .Kind "unreachable"}}is unreachable because its parent is down{{else if eq .Kind "hosts"}}live hosts changed{{if .Appeared}}, appeared: {{.Appeared}}{{end}}{{if .Disappeared}}, disappeared: {{.Disappeared}}{{end}}{{else}}is {{.State}}{{end}}`
+
+//Alert is a notification about a Device
+type Alert struct {
+	Kind          AlertKind
+	Device        *Device
+	IP            net.IP
+	Time          time.Time
+	PreviousState State
+	State         State
+	Flapping      bool
+	Loss          float64
+	AvgRTT        time.Duration
+	//Appeared and Disappeared are the hosts that changed for AlertHosts
+	Appeared    []net.IP
+	Disappeared []net.IP
+	Message     string
+}
+
+//Notifier sends Alerts to a destination
+type Notifier interface {
+	Name() string
+	Notify(a *Alert) error
+}
+
+//AlertThresholds configures when threshold Alerts are sent
+type AlertThresholds struct {
+	//Loss is the loss percentage at or above which an Alert is sent. If zero, loss is ignored
+	Loss float64
+	//RTT is the average RTT above which an Alert is sent. If zero, RTT is ignored
+	RTT time.Duration
+}
+
+//lastAlert is the last Alert sent for a subject
+type lastAlert struct {
+	kind AlertKind
+	time time.Time
+}
+
+//NotifyService turns Events and Pings into Alerts and sends them to Notifiers. Each Notifier has its own queue so a
+//slow or failing Notifier doesn't affect the others. Failures are retried with exponential backoff, and an Alert
+//of the same kind for the same subject is only sent once per dedup window
+type NotifyService struct {
+	queues     map[Notifier]chan *Alert
+	thresholds *AlertThresholds
+	tmpl       *template.Template
+
+	dedup  time.Duration
+	last   map[string]*lastAlert
+	lastMu *sync.Mutex
+
+	retries     int
+	unreachable bool
+}
+
+//NewNotifyService returns a new NotifyService for the given Notifiers. Alerts for Devices that are unreachable because
+//their parent is down are only sent if unreachable is true
+func NewNotifyService(notifiers []Notifier, thresholds *AlertThresholds, tmpl string, dedup time.Duration, retries, buffer int, unreachable bool) (*NotifyService, error) {
+	if tmpl == "" {
+		tmpl = DefaultAlertTemplate
+	}
+	t, err := template.New("alert").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse template: %v", err)
+	}
+
+	n := &NotifyService{
+		queues:      make(map[Notifier]chan *Alert),
+		thresholds:  thresholds,
+		tmpl:        t,
+		dedup:       dedup,
+		last:        make(map[string]*lastAlert),
+		lastMu:      new(sync.Mutex),
+		retries:     retries,
+		unreachable: unreachable,
+	}
+
+	for _, nt := range notifiers {
+		q := make(chan *Alert, buffer)
+		n.queues[nt] = q
+		go n.sender(nt, q)
+		log.Println("NotifyService: Sending Alerts to:", nt.Name())
+	}
+
+	return n, nil
+}
+
+func (n *NotifyService) sender(nt Notifier, q <-chan *Alert) {
+	for a := range q {
+		backoff := time.Second
+		for attempt := 0; ; attempt++ {
+			err := nt.Notify(a)
+			if err == nil {
+				break
+			}
+			if attempt >= n.retries {
+				log.Printf("NotifyService: Unable to send Alert to %s, giving up: %v\n", nt.Name(), err)
+				break
+			}
+			log.Printf("NotifyService: Unable to send Alert to %s, retrying in %v: %v\n", nt.Name(), backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+//subject returns the key used to deduplicate a
+func subject(a *Alert) string {
+	s := a.Device.ID
+	if a.IP != nil {
+		s += "/" + a.IP.String()
+	}
+	if a.Kind == AlertThreshold {
+		s += "/threshold"
+	}
+	return s
+}
+
+//duplicate returns true if an Alert of the same kind was sent for the same subject within the dedup window,
+//and records the Alert otherwise. A recovery is also a duplicate unless the last Alert sent for the subject was down
+//or unreachable, so recoveries are only sent for outages that were alerted, e.g. not for a Device that was only
+//degraded or went down during a MaintenanceWindow
+func (n *NotifyService) duplicate(a *Alert) bool {
+	s := subject(a)
+
+	n.lastMu.Lock()
+	defer n.lastMu.Unlock()
+
+	//every change to live hosts is different
+	if a.Kind == AlertHosts {
+		return false
+	}
+
+	l, ok := n.last[s]
+	if ok && l.kind == a.Kind && a.Time.Sub(l.time) < n.dedup {
+		return true
+	}
+	if a.Kind == AlertRecovered && (!ok || (l.kind != AlertDown && l.kind != AlertUnreachable)) {
+		return true
+	}
+	n.last[s] = &lastAlert{kind: a.Kind, time: a.Time}
+	return false
+}
+
+//send renders and queues a to every Notifier
+func (n *NotifyService) send(a *Alert) {
+	if len(n.queues) == 0 || n.duplicate(a) {
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	if err := n.tmpl.Execute(buf, a); err != nil {
+		log.Println("NotifyService: Unable to render Alert:", err)
+		a.Message = fmt.Sprintf("%s is %s", a.Device.Hostname, a.State)
+	} else {
+		a.Message = buf.String()
+	}
+
+	for nt, q := range n.queues {
+		select {
+		case q <- a:
+		default:
+			log.Printf("NotifyService: Queue for %s is full, dropping Alert\n", nt.Name())
+		}
+	}
+}
+
+//HandleEvent sends an Alert if e is a Device going down, becoming unreachable, or recovering from an alerted outage
+func (n *NotifyService) HandleEvent(e *Event) {
+	if e.IP != nil {
+		return
+	}
+
+	a := &Alert{Device: e.Device, Time: e.Time, PreviousState: e.PreviousState, State: e.State, Flapping: e.Flapping}
+	switch {
+	case e.State == StateDown:
+		a.Kind = AlertDown
+	case e.State == StateUnreachable && n.unreachable:
+		a.Kind = AlertUnreachable
+	//the outage may have ended through degraded, so whether it was alerted is checked by duplicate
+	case e.State == StateUp && e.PreviousState != StateUnknown:
+		a.Kind = AlertRecovered
+	default:
+		return
+	}
+
+	n.send(a)
+}
+
+//HandlePing sends an Alert if p exceeds the loss or latency thresholds
+func (n *NotifyService) HandlePing(p *Ping) {
+	//total loss is handled by down Alerts
+	if p.Received == 0 {
+		return
+	}
+
+	loss := n.thresholds.Loss > 0 && p.Loss >= n.thresholds.Loss
+	rtt := n.thresholds.RTT > 0 && p.AvgRTT > n.thresholds.RTT
+	if !loss && !rtt {
+		return
+	}
+
+	n.send(&Alert{
+		Kind:   AlertThreshold,
+		Device: p.Device,
+		IP:     p.IP,
+		Time:   p.SentTime,
+		Loss:   p.Loss,
+		AvgRTT: p.AvgRTT,
+	})
+}
+
+//HandleHosts sends an Alert for hosts appearing and disappearing in the subnet sweep d
+func (n *NotifyService) HandleHosts(d *Device, appeared, disappeared []net.IP, t time.Time) {
+	n.send(&Alert{
+		Kind:        AlertHosts,
+		Device:      d,
+		Time:        t,
+		Appeared:    appeared,
+		Disappeared: disappeared,
+	})
+}
@@ -1,99 +1,394 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"math"
 	"net"
 	"strings"
 	"sync"
 	"time"
+)
+
+//targetTTL is how long a target's sequence counter is kept after its last probe
+const targetTTL = time.Hour
+
+//tokenLength is the length of the HMAC token embedded in each Echo Request payload
+const tokenLength = 16
+
+//maxSweepRate is the maximum sweep rate in Probes per second. Faster rates would need a sweep ticker period shorter
+//than the scheduler can reliably deliver
+const maxSweepRate = 100000
 
-	"github.com/korylprince/go-icmpv4/v2/echo"
+//Family is an IP address family
+type Family int
+
+//Supported address families
+const (
+	FamilyIPv4 Family = 4
+	FamilyIPv6 Family = 6
 )
 
-const ICMPEchoRequestIdentifier uint16 = 0x3039
+func (f Family) String() string {
+	if f == FamilyIPv6 {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+//familyOf returns the Family of ip
+func familyOf(ip net.IP) Family {
+	if ip.To4() != nil {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+//Probe is a single Echo Request sent to an IP
+type Probe struct {
+	Identifier uint16
+	Sequence   uint16
+	SentTime   time.Time
+	RecvTime   *time.Time
+
+	ping *Ping
+}
+
+//RTT returns the round trip time of the Probe, or false if no reply was received
+func (p *Probe) RTT() (time.Duration, bool) {
+	if p.RecvTime == nil {
+		return 0, false
+	}
+	return p.RecvTime.Sub(p.SentTime), true
+}
 
+//Ping is the result of a burst of Probes sent to a single IP
 type Ping struct {
 	*Device
 	IP       net.IP
-	Sequence uint16
+	Family   Family
 	SentTime time.Time
-	RecvTime *time.Time
+	Probes   []*Probe
+
+	Sent     int
+	Received int
+	Loss     float64 //percentage of Probes lost
+	MinRTT   time.Duration
+	AvgRTT   time.Duration
+	MaxRTT   time.Duration
+	StdDev   time.Duration
+	Jitter   time.Duration //mean difference between consecutive RTTs
+
+	//Planned is true if the Ping was sent during a MaintenanceWindow
+	Planned bool
+
+	timeout     time.Duration
+	outstanding int
+}
+
+//summarize computes the Ping's statistics from its Probes
+func (p *Ping) summarize() {
+	rtts := make([]time.Duration, 0, len(p.Probes))
+	for _, probe := range p.Probes {
+		if rtt, ok := probe.RTT(); ok {
+			rtts = append(rtts, rtt)
+		}
+	}
+
+	p.Sent = len(p.Probes)
+	p.Received = len(rtts)
+	if p.Sent > 0 {
+		p.Loss = float64(p.Sent-p.Received) * 100 / float64(p.Sent)
+	}
+	if p.Received == 0 {
+		return
+	}
+
+	var sum, jitter time.Duration
+	p.MinRTT, p.MaxRTT = rtts[0], rtts[0]
+	for i, rtt := range rtts {
+		sum += rtt
+		if rtt < p.MinRTT {
+			p.MinRTT = rtt
+		}
+		if rtt > p.MaxRTT {
+			p.MaxRTT = rtt
+		}
+		if i > 0 {
+			d := rtt - rtts[i-1]
+			if d < 0 {
+				d = -d
+			}
+			jitter += d
+		}
+	}
+	p.AvgRTT = sum / time.Duration(len(rtts))
+
+	if len(rtts) > 1 {
+		var sq float64
+		for _, rtt := range rtts {
+			d := float64(rtt - p.AvgRTT)
+			sq += d * d
+		}
+		p.StdDev = time.Duration(math.Sqrt(sq / float64(len(rtts)-1)))
+		p.Jitter = jitter / time.Duration(len(rtts)-1)
+	}
+}
+
+//sender is an identifier on a socket that Echo Requests can be sent from
+type sender struct {
+	conn       *echoConn
+	identifier uint16
+}
+
+//target tracks the sender and next sequence for a single IP
+type target struct {
+	sender   *sender
+	sequence uint16
+	lastUsed time.Time
+}
+
+//probeKey identifies an in-flight Echo Request
+type probeKey struct {
+	ip         [16]byte
+	identifier uint16
+	sequence   uint16
+}
+
+func newProbeKey(ip net.IP, identifier, sequence uint16) probeKey {
+	k := probeKey{identifier: identifier, sequence: sequence}
+	copy(k.ip[:], ip.To16())
+	return k
 }
 
 type PingService struct {
-	sequence chan uint16
+	senders map[Family][]*sender
+
+	targets   map[[16]byte]*target
+	targetsMu *sync.Mutex
+
+	//key is used to sign the probe token embedded in each Echo Request
+	key []byte
 
 	devices  chan *Device
 	requests chan *Ping
 
-	packets chan *echo.IPPacket
 	replies chan *pong
 
-	pending   map[uint16]*Ping
+	pending   map[probeKey]*Probe
 	pendingMu *sync.RWMutex
 
+	//lastReply is the time the last valid reply was received. pendingMu must be held
+	lastReply *time.Time
+
+	spacing time.Duration
+
+	//sweepTick limits the rate of Probes sent to subnet sweep Devices
+	sweepTick <-chan time.Time
+	sweeping  map[string]struct{}
+	sweepMu   *sync.Mutex
+
 	listener func(p *Ping)
 
 	errors chan error
 }
 
-func (p *PingService) sequencer() {
-	var s uint16 = 0
-	for {
-		p.sequence <- s
-		s++
+//nextProbe returns the sender and next sequence for ip. Targets are spread over senders by a hash of their IP
+//so each target always uses the same identifier and has its own sequence space
+func (p *PingService) nextProbe(ip net.IP) (*sender, uint16, bool) {
+	var k [16]byte
+	copy(k[:], ip.To16())
+
+	p.targetsMu.Lock()
+	defer p.targetsMu.Unlock()
+
+	t, ok := p.targets[k]
+	if !ok {
+		senders := p.senders[familyOf(ip)]
+		if len(senders) == 0 {
+			return nil, 0, false
+		}
+		h := fnv.New32a()
+		h.Write(k[:])
+		t = &target{sender: senders[h.Sum32()%uint32(len(senders))]}
+		p.targets[k] = t
 	}
+
+	seq := t.sequence
+	t.sequence++
+	t.lastUsed = time.Now()
+	return t.sender, seq, true
 }
 
-func (p *PingService) nextSequence() uint16 {
-	return <-(p.sequence)
+//token returns the HMAC of the probe's identity and sent time
+func (p *PingService) token(ip net.IP, identifier, sequence uint16, sent int64) []byte {
+	b := make([]byte, 16+2+2+8)
+	copy(b, ip.To16())
+	binary.BigEndian.PutUint16(b[16:], identifier)
+	binary.BigEndian.PutUint16(b[18:], sequence)
+	binary.BigEndian.PutUint64(b[20:], uint64(sent))
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write(b)
+	return mac.Sum(nil)[:tokenLength]
+}
+
+//payload returns the Echo Request payload for a probe: the sent time followed by the probe's token
+func (p *PingService) payload(ip net.IP, identifier, sequence uint16, sent time.Time) []byte {
+	b := make([]byte, 8, 8+tokenLength)
+	binary.BigEndian.PutUint64(b, uint64(sent.UnixNano()))
+	return append(b, p.token(ip, identifier, sequence, sent.UnixNano())...)
+}
+
+//validate returns true if payload was created for req
+func (p *PingService) validate(req *Probe, payload []byte) bool {
+	if len(payload) < 8+tokenLength {
+		return false
+	}
+	sent := int64(binary.BigEndian.Uint64(payload))
+	if sent != req.SentTime.UnixNano() {
+		return false
+	}
+	return hmac.Equal(payload[8:8+tokenLength], p.token(req.ping.IP, req.Identifier, req.Sequence, sent))
+}
+
+//finish marks one of the Ping's Probes as done. Once all Probes are done, the Ping is summarized and passed to
+//the listener. pendingMu must be held
+func (p *PingService) finish(ping *Ping) {
+	ping.outstanding--
+	if ping.outstanding > 0 {
+		return
+	}
+	ping.summarize()
+	if ping.Sent > 0 && p.listener != nil {
+		go p.listener(ping)
+	}
+}
+
+//send sends a single Probe for ping
+func (p *PingService) send(ping *Ping) {
+	s, seq, ok := p.nextProbe(ping.IP)
+	if !ok {
+		p.pendingMu.Lock()
+		p.finish(ping)
+		p.pendingMu.Unlock()
+		return
+	}
+
+	key := newProbeKey(ping.IP, s.identifier, seq)
+	t := time.Now()
+	probe := &Probe{Identifier: s.identifier, Sequence: seq, SentTime: t, ping: ping}
+	p.pendingMu.Lock()
+	if len(ping.Probes) == 0 {
+		ping.SentTime = t
+	}
+	ping.Probes = append(ping.Probes, probe)
+	p.pending[key] = probe
+	p.pendingMu.Unlock()
+
+	if err := s.conn.Send(ping.IP, s.identifier, seq, p.payload(ping.IP, s.identifier, seq, t)); err != nil {
+		log.Printf("PingService: Unable to send ping request to %v: %v", ping.IP, err)
+		p.pendingMu.Lock()
+		delete(p.pending, key)
+		for i, pr := range ping.Probes {
+			if pr == probe {
+				ping.Probes = append(ping.Probes[:i], ping.Probes[i+1:]...)
+				break
+			}
+		}
+		p.finish(ping)
+		p.pendingMu.Unlock()
+	}
+}
+
+//sendAll sends a single Probe for each ping
+func (p *PingService) sendAll(pings []*Ping) {
+	for _, ping := range pings {
+		p.send(ping)
+	}
+}
+
+//sweep sends each Probe for pings at the sweep rate. If the previous sweep of the Device is still running, the sweep
+//is skipped
+func (p *PingService) sweep(id string, pings []*Ping, count int) {
+	p.sweepMu.Lock()
+	if _, ok := p.sweeping[id]; ok {
+		p.sweepMu.Unlock()
+		log.Printf("PingService: Previous sweep of %s still running, skipping\n", id)
+		return
+	}
+	p.sweeping[id] = struct{}{}
+	p.sweepMu.Unlock()
+
+	defer func() {
+		p.sweepMu.Lock()
+		delete(p.sweeping, id)
+		p.sweepMu.Unlock()
+	}()
+
+	for _, ping := range pings {
+		for i := 0; i < count; i++ {
+			<-p.sweepTick
+			p.send(ping)
+		}
+	}
 }
 
 func (p *PingService) requester() {
 	for d := range p.devices {
 		d.mu.RLock()
-		ips := make([]net.IP, len(d.ips))
-		copy(ips, d.ips)
+		count, timeout := d.probe.Count, d.probe.Timeout
+		pings := make([]*Ping, 0, len(d.ips))
+		snap := d.snapshot()
+		for _, ip := range d.ips {
+			pings = append(pings, &Ping{Device: snap, IP: ip, Family: familyOf(ip), Probes: make([]*Probe, 0, count), timeout: timeout, outstanding: count})
+		}
+		sweep := d.Subnet != nil
 		d.mu.RUnlock()
-		for _, ip := range ips {
-			seq := p.nextSequence()
-			t := time.Now()
-			p.pendingMu.Lock()
-			p.pending[seq] = &Ping{Device: d, IP: ip, Sequence: seq, SentTime: t}
-			p.pendingMu.Unlock()
-			err := echo.Send(nil, &net.IPAddr{IP: ip}, ICMPEchoRequestIdentifier, seq)
-			if err != nil {
-				log.Printf("PingService: Unable to send ping request to %v: %v", ip, err)
-				p.pendingMu.Lock()
-				delete(p.pending, seq)
-				p.pendingMu.Unlock()
-			}
+
+		if count < 1 {
+			continue
+		}
+
+		if sweep {
+			go p.sweep(d.ID, pings, count)
+			continue
+		}
+
+		p.sendAll(pings)
+		for i := 1; i < count; i++ {
+			time.AfterFunc(time.Duration(i)*p.spacing, func() { p.sendAll(pings) })
 		}
 	}
 }
 
 type pong struct {
-	IP       net.IP
-	Sequence uint16
-	RecvTime time.Time
+	IP         net.IP
+	Identifier uint16
+	Sequence   uint16
+	Payload    []byte
+	RecvTime   time.Time
 }
 
 func (p *PingService) receiver() {
-	for pk := range p.packets {
-		recv := time.Now()
-		if pk.Identifier() != ICMPEchoRequestIdentifier {
-			continue
-		}
+	for pk := range p.replies {
+		recv := pk.RecvTime
 		p.pendingMu.Lock()
-		if req, ok := p.pending[pk.Sequence()]; ok {
-			if req.IP.Equal(pk.RemoteAddr.IP) {
+		if req, ok := p.pending[newProbeKey(pk.IP, pk.Identifier, pk.Sequence)]; ok {
+			if recv.After(req.SentTime.Add(req.ping.timeout)) {
+				log.Printf("PingService: Late reply: IP %s, Identifier: %d, Sequence: %d\n", pk.IP.String(), pk.Identifier, pk.Sequence)
+			} else if p.validate(req, pk.Payload) {
 				req.RecvTime = &recv
+				p.lastReply = &recv
 			} else {
-				log.Printf("PingService: Mismatched IP: Original IP %s, Received IP: %s, Sequence: %d\n", req.IP.String(), pk.RemoteAddr.IP.String(), req.Sequence)
+				log.Printf("PingService: Invalid probe token: IP %s, Identifier: %d, Sequence: %d\n", pk.IP.String(), pk.Identifier, pk.Sequence)
 			}
 		} else {
-			log.Printf("PingService: Unknown Sequence: IP %s, Sequence: %d\n", pk.RemoteAddr.IP.String(), pk.Sequence())
+			log.Printf("PingService: Unknown probe: IP %s, Identifier: %d, Sequence: %d\n", pk.IP.String(), pk.Identifier, pk.Sequence)
 		}
 		p.pendingMu.Unlock()
 	}
@@ -103,23 +398,29 @@ func (p *PingService) scavenger(timeout time.Duration) {
 	for {
 		time.Sleep(timeout / 2)
 		p.pendingMu.Lock()
-		done := make([]uint16, 0)
+		done := make([]probeKey, 0)
 
-		for seq, req := range p.pending {
-			if req.RecvTime != nil || time.Now().After(req.SentTime.Add(timeout)) {
-				done = append(done, seq)
+		for key, req := range p.pending {
+			if req.RecvTime != nil || time.Now().After(req.SentTime.Add(req.ping.timeout)) {
+				done = append(done, key)
 			}
 		}
 
 		if len(done) > 0 {
-			for _, seq := range done {
-				if p.listener != nil {
-					go p.listener(p.pending[seq])
-				}
-				delete(p.pending, seq)
+			for _, key := range done {
+				p.finish(p.pending[key].ping)
+				delete(p.pending, key)
 			}
 		}
 		p.pendingMu.Unlock()
+
+		p.targetsMu.Lock()
+		for k, t := range p.targets {
+			if time.Since(t.lastUsed) > targetTTL {
+				delete(p.targets, k)
+			}
+		}
+		p.targetsMu.Unlock()
 	}
 }
 
@@ -129,32 +430,59 @@ func (p *PingService) errorLogger() {
 	}
 }
 
-func NewPingService(workers, buffer int, timeout time.Duration) (*PingService, error) {
+//NewPingService returns a new PingService. Subnet sweep Devices are pinged at up to sweepRate Probes per second
+func NewPingService(workers, buffer int, timeout time.Duration, mode SocketMode, identifiers int, spacing time.Duration, sweepRate int) (*PingService, error) {
+	if sweepRate < 1 || sweepRate > maxSweepRate {
+		return nil, fmt.Errorf("Invalid sweep rate: %d (must be between 1 and %d)", sweepRate, maxSweepRate)
+	}
+	if identifiers < 1 || identifiers > math.MaxUint16 {
+		return nil, fmt.Errorf("Invalid identifiers: %d (must be between 1 and %d)", identifiers, math.MaxUint16)
+	}
+
 	p := &PingService{
-		sequence:  make(chan uint16),
+		senders:   make(map[Family][]*sender),
+		targets:   make(map[[16]byte]*target),
+		targetsMu: new(sync.Mutex),
+		key:       make([]byte, sha256.Size),
 		devices:   make(chan *Device),
 		requests:  make(chan *Ping, buffer),
-		packets:   make(chan *echo.IPPacket, buffer),
 		replies:   make(chan *pong, buffer),
-		pending:   make(map[uint16]*Ping),
+		pending:   make(map[probeKey]*Probe),
 		pendingMu: new(sync.RWMutex),
+		spacing:   spacing,
+		sweepTick: time.NewTicker(time.Second / time.Duration(sweepRate)).C,
+		sweeping:  make(map[string]struct{}),
+		sweepMu:   new(sync.Mutex),
 		errors:    make(chan error),
 	}
 
-	ips, err := echo.ListenerAll(p.packets, p.errors, nil)
+	if _, err := rand.Read(p.key); err != nil {
+		return nil, fmt.Errorf("Unable to generate probe key: %v", err)
+	}
+
+	conns, err := listenEcho(FamilyIPv4, mode, identifiers)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to start listeners: %v", err)
+		return nil, fmt.Errorf("Unable to start IPv4 listener: %v", err)
+	}
+
+	if conns6, err := listenEcho(FamilyIPv6, mode, identifiers); err != nil {
+		log.Println("PingService: Unable to start IPv6 listener, IPv6 devices will not be pinged:", err)
+	} else {
+		conns = append(conns, conns6...)
 	}
 
-	ipStrs := make([]string, 0)
-	for _, ip := range ips {
-		ipStrs = append(ipStrs, ip.String())
+	addrs := make([]string, 0)
+	for _, c := range conns {
+		for _, id := range c.identifiers {
+			p.senders[c.family] = append(p.senders[c.family], &sender{conn: c, identifier: id})
+		}
+		addrs = append(addrs, c.String())
+		go c.Listener(p.replies, p.errors)
 	}
 
-	log.Println("PingService: Listening on:", strings.Join(ipStrs, ", "))
+	log.Println("PingService: Listening on:", strings.Join(addrs, ", "))
 
 	log.Println("PingService: Starting", workers, "workers")
-	go p.sequencer()
 	for i := 0; i < workers; i++ {
 		go p.requester()
 	}
@@ -169,6 +497,40 @@ func (p *PingService) SetListener(f func(p *Ping)) {
 	p.listener = f
 }
 
+//Pending returns the number of Probes waiting for a reply
+func (p *PingService) Pending() int {
+	p.pendingMu.RLock()
+	defer p.pendingMu.RUnlock()
+	return len(p.pending)
+}
+
+//PingStatus is the status of the PingService
+type PingStatus struct {
+	//Listeners is the number of sockets listening for replies by address family
+	Listeners map[string]int `json:"listeners"`
+	LastReply *time.Time     `json:"last_reply"`
+	Pending   int            `json:"pending"`
+}
+
+//Status returns the current status of the PingService
+func (p *PingService) Status() *PingStatus {
+	s := &PingStatus{Listeners: make(map[string]int)}
+	for family, senders := range p.senders {
+		conns := make(map[*echoConn]struct{})
+		for _, sn := range senders {
+			conns[sn.conn] = struct{}{}
+		}
+		s.Listeners[family.String()] = len(conns)
+	}
+
+	p.pendingMu.RLock()
+	s.LastReply = p.lastReply
+	s.Pending = len(p.pending)
+	p.pendingMu.RUnlock()
+
+	return s
+}
+
 func (p *PingService) Ping(d *Device) {
 	p.devices <- d
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewPingServiceSweepRate(t *testing.T) {
+	//invalid rates are rejected before any sockets are opened
+	for _, rate := range []int{-1, 0, maxSweepRate + 1, int(time.Second) + 1} {
+		if _, err := NewPingService(1, 1, time.Second, SocketModeAuto, 1, 0, rate); err == nil {
+			t.Errorf("%d: err = nil, want an error", rate)
+		}
+	}
+}
+
+func TestNewPingServiceIdentifiers(t *testing.T) {
+	//invalid identifier counts are rejected before any sockets are opened
+	for _, n := range []int{-1, 0, 65536, 1 << 20} {
+		if _, err := NewPingService(1, 1, time.Second, SocketModeAuto, n, 0, 100); err == nil {
+			t.Errorf("%d: err = nil, want an error", n)
+		}
+	}
+}
+
+func TestRandomIdentifiers(t *testing.T) {
+	for _, n := range []int{1, 4, 1000, 65535} {
+		ids, err := randomIdentifiers(n)
+		if err != nil {
+			t.Fatalf("%d: Unable to generate identifiers: %v", n, err)
+		}
+		seen := make(map[uint16]struct{})
+		for _, id := range ids {
+			seen[id] = struct{}{}
+		}
+		if len(ids) != n || len(seen) != n {
+			t.Errorf("%d: %d identifiers, %d unique, want %d", n, len(ids), len(seen), n)
+		}
+	}
+}
+
+func TestPingServiceValidate(t *testing.T) {
+	p := &PingService{key: []byte("key")}
+	sent := time.Unix(1, 2)
+	ip := net.ParseIP("192.0.2.1")
+	payload := p.payload(ip, 1, 2, sent)
+
+	probe := func(ip string, identifier, sequence uint16, sent time.Time) *Probe {
+		return &Probe{Identifier: identifier, Sequence: sequence, SentTime: sent, ping: &Ping{IP: net.ParseIP(ip)}}
+	}
+	tampered := append([]byte(nil), payload...)
+	tampered[len(tampered)-1]++
+
+	tests := []struct {
+		name    string
+		p       *PingService
+		req     *Probe
+		payload []byte
+		want    bool
+	}{
+		{"valid", p, probe("192.0.2.1", 1, 2, sent), payload, true},
+		//IPv4-mapped addresses are the same IP
+		{"mapped", p, probe("::ffff:192.0.2.1", 1, 2, sent), payload, true},
+		{"ip", p, probe("192.0.2.2", 1, 2, sent), payload, false},
+		{"identifier", p, probe("192.0.2.1", 2, 2, sent), payload, false},
+		{"sequence", p, probe("192.0.2.1", 1, 3, sent), payload, false},
+		{"sent time", p, probe("192.0.2.1", 1, 2, sent.Add(1)), payload, false},
+		{"tampered", p, probe("192.0.2.1", 1, 2, sent), tampered, false},
+		{"short", p, probe("192.0.2.1", 1, 2, sent), payload[:len(payload)-1], false},
+		{"empty", p, probe("192.0.2.1", 1, 2, sent), nil, false},
+		//another PingService, e.g. another instance on the same host, has a different key
+		{"key", &PingService{key: []byte("other")}, probe("192.0.2.1", 1, 2, sent), payload, false},
+	}
+	for _, test := range tests {
+		if got := test.p.validate(test.req, test.payload); got != test.want {
+			t.Errorf("%s: valid = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+//TestPostgresSink runs against the database in POSTGRESURL, which must have the schema in schema/ loaded. It's
+//skipped if POSTGRESURL isn't set
+func TestPostgresSink(t *testing.T) {
+	url := os.Getenv("POSTGRESURL")
+	if url == "" {
+		t.Skip("POSTGRESURL not set")
+	}
+
+	s, err := NewPostgresSink(url)
+	if err != nil {
+		t.Fatalf("Unable to create PostgresSink: %v", err)
+	}
+	defer s.db.Close()
+
+	name := fmt.Sprintf("pinger-test-%d", time.Now().UnixNano())
+	var typeID, deviceID string
+	if err = s.db.QueryRow("INSERT INTO device_type (name) VALUES ($1) RETURNING id", name).Scan(&typeID); err != nil {
+		t.Fatalf("Unable to insert device_type: %v", err)
+	}
+	defer s.db.Exec("DELETE FROM device_type WHERE id = $1", typeID)
+	if err = s.db.QueryRow("INSERT INTO device (device_type_id, hostname) VALUES ($1, $2) RETURNING id", typeID, name).Scan(&deviceID); err != nil {
+		t.Fatalf("Unable to insert device: %v", err)
+	}
+	//pings and events are deleted with the device
+	defer s.db.Exec("DELETE FROM device WHERE id = $1", deviceID)
+
+	d := testDevice(deviceID, name)
+	start := time.Now().UTC().Truncate(time.Second)
+	ping := func(sec int, rtt time.Duration) *Ping {
+		return &Ping{
+			Device: d, IP: net.ParseIP("192.0.2.1"), SentTime: start.Add(time.Duration(sec) * time.Second),
+			Sent: 2, Received: 2, MinRTT: rtt, AvgRTT: rtt, MaxRTT: rtt,
+		}
+	}
+
+	tests := []struct {
+		name  string
+		pings []*Ping
+		count int
+	}{
+		{"insert", []*Ping{ping(0, 10*time.Millisecond), ping(1, 10*time.Millisecond)}, 2},
+		{"conflict with existing rows", []*Ping{ping(1, 20*time.Millisecond), ping(2, 20*time.Millisecond)}, 3},
+		{"conflict within batch", []*Ping{ping(3, 30*time.Millisecond), ping(3, 40*time.Millisecond)}, 4},
+		{"all conflicting", []*Ping{ping(0, 50*time.Millisecond)}, 4},
+	}
+
+	for _, test := range tests {
+		if err = s.WritePings(test.pings); err != nil {
+			t.Fatalf("%s: Unable to write Pings: %v", test.name, err)
+		}
+		var count int
+		if err = s.db.QueryRow("SELECT COUNT(*) FROM ping WHERE device_id = $1", deviceID).Scan(&count); err != nil {
+			t.Fatalf("%s: Unable to count Pings: %v", test.name, err)
+		}
+		if count != test.count {
+			t.Errorf("%s: count = %d, want %d", test.name, count, test.count)
+		}
+	}
+
+	//the first row written is kept
+	for sec, want := range map[int]int64{0: 10, 1: 10, 2: 20, 3: 30} {
+		var rtt int64
+		if err = s.db.QueryRow("SELECT rtt FROM ping WHERE device_id = $1 AND sent_time = $2", deviceID, start.Add(time.Duration(sec)*time.Second)).Scan(&rtt); err != nil {
+			t.Fatalf("Unable to query Ping %d: %v", sec, err)
+		}
+		if rtt != want {
+			t.Errorf("Ping %d: rtt = %d, want %d", sec, rtt, want)
+		}
+	}
+
+	events := []*Event{
+		{Device: d, Time: start, PreviousState: StateUnknown, State: StateUp},
+		{Device: d, IP: net.ParseIP("192.0.2.1"), Time: start.Add(time.Second), PreviousState: StateUp, State: StateDown},
+	}
+	if err = s.WriteEvents(events); err != nil {
+		t.Fatalf("Unable to write Events: %v", err)
+	}
+	var count int
+	if err = s.db.QueryRow("SELECT COUNT(*) FROM device_event WHERE device_id = $1 AND ip IS NOT NULL", deviceID).Scan(&count); err != nil {
+		t.Fatalf("Unable to count Events: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("IP Events = %d, want 1", count)
+	}
+
+	//a Ping for a deleted Device rolls back the whole batch
+	if err = s.WritePings([]*Ping{ping(4, 0), {Device: testDevice("00000000-0000-0000-0000-000000000000", "missing"), IP: net.ParseIP("192.0.2.2"), SentTime: start, Sent: 1}}); err == nil {
+		t.Error("Expected error writing Ping for missing Device")
+	}
+	if err = s.db.QueryRow("SELECT COUNT(*) FROM ping WHERE device_id = $1", deviceID).Scan(&count); err != nil {
+		t.Fatalf("Unable to count Pings: %v", err)
+	}
+	if count != 4 {
+		t.Errorf("count after failed batch = %d, want 4", count)
+	}
+}
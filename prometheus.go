@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+//remote write backoff limits
+const (
+	remoteWriteMinBackoff = time.Second
+	remoteWriteMaxBackoff = 30 * time.Second
+)
+
+//protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+//protoBuffer encodes protobuf messages
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (b *protoBuffer) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (b *protoBuffer) tag(field, wire int) {
+	b.varint(uint64(field<<3 | wire))
+}
+
+func (b *protoBuffer) bytesField(field int, v []byte) {
+	b.tag(field, wireBytes)
+	b.varint(uint64(len(v)))
+	b.Write(v)
+}
+
+func (b *protoBuffer) stringField(field int, v string) {
+	b.bytesField(field, []byte(v))
+}
+
+func (b *protoBuffer) doubleField(field int, v float64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	b.tag(field, wireFixed64)
+	b.Write(buf[:])
+}
+
+func (b *protoBuffer) int64Field(field int, v int64) {
+	b.tag(field, wireVarint)
+	b.varint(uint64(v))
+}
+
+//remoteSample is a Prometheus sample
+type remoteSample struct {
+	value     float64
+	timestamp int64 //in milliseconds
+}
+
+//remoteSeries is a Prometheus time series. labels are name, value pairs sorted by name
+type remoteSeries struct {
+	labels  []string
+	samples []remoteSample
+}
+
+//encodeWriteRequest returns series encoded as a prometheus.WriteRequest
+func encodeWriteRequest(series []*remoteSeries) []byte {
+	req := new(protoBuffer)
+	for _, s := range series {
+		ts := new(protoBuffer)
+		for i := 0; i < len(s.labels); i += 2 {
+			l := new(protoBuffer)
+			l.stringField(1, s.labels[i])
+			l.stringField(2, s.labels[i+1])
+			ts.bytesField(1, l.Bytes())
+		}
+		for _, sample := range s.samples {
+			sm := new(protoBuffer)
+			sm.doubleField(1, sample.value)
+			sm.int64Field(2, sample.timestamp)
+			ts.bytesField(2, sm.Bytes())
+		}
+		req.bytesField(1, ts.Bytes())
+	}
+	return req.Bytes()
+}
+
+//PrometheusSink is a ResultSink that pushes Ping RTT and loss to a Prometheus remote write endpoint, e.g. Mimir or
+//Cortex. Failed writes are retried with exponential backoff
+type PrometheusSink struct {
+	url     string
+	headers map[string]string
+	retries int
+	client  *http.Client
+}
+
+//NewPrometheusSink returns a new PrometheusSink that writes to url with the given extra headers (e.g. X-Scope-OrgID or
+//Authorization), retrying failed writes up to retries times
+func NewPrometheusSink(url string, headers map[string]string, retries int) (*PrometheusSink, error) {
+	if url == "" {
+		return nil, fmt.Errorf("URL is required")
+	}
+	if retries < 0 {
+		return nil, fmt.Errorf("Invalid retries: %d", retries)
+	}
+
+	log.Printf("PrometheusSink: Writing to %s\n", url)
+
+	return &PrometheusSink{url: url, headers: headers, retries: retries, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (s *PrometheusSink) Name() string {
+	return "prometheus"
+}
+
+//Ordered is implemented because remote write endpoints reject samples older than the latest sample in their series.
+//A batch that's retried concurrently with a later batch would be rejected and lost
+func (s *PrometheusSink) Ordered() {}
+
+//series returns the time series for pings. Samples for the same series are merged and sorted by time
+func (s *PrometheusSink) series(pings []*Ping) []*remoteSeries {
+	series := make([]*remoteSeries, 0)
+	index := make(map[string]*remoteSeries)
+
+	add := func(name string, p *Ping, value float64) {
+		//labels sorted by name
+		labels := []string{"__name__", name, "device_id", p.Device.ID}
+		if p.Device.DeviceType != nil {
+			labels = append(labels, "device_type", p.Device.DeviceType.Name)
+		}
+		labels = append(labels, "hostname", p.Device.Hostname, "ip", p.IP.String())
+
+		key := strings.Join(labels, "\xff")
+		rs, ok := index[key]
+		if !ok {
+			rs = &remoteSeries{labels: labels}
+			index[key] = rs
+			series = append(series, rs)
+		}
+		rs.samples = append(rs.samples, remoteSample{value: value, timestamp: p.SentTime.UnixNano() / int64(time.Millisecond)})
+	}
+
+	for _, p := range pings {
+		add("net_monitor_ping_loss_ratio", p, p.Loss/100)
+		if p.Received > 0 {
+			add("net_monitor_ping_rtt_seconds", p, p.AvgRTT.Seconds())
+		}
+	}
+
+	for _, rs := range series {
+		sort.SliceStable(rs.samples, func(i, j int) bool {
+			return rs.samples[i].timestamp < rs.samples[j].timestamp
+		})
+	}
+
+	return series
+}
+
+//post sends body to the remote write endpoint. The returned bool is true if the write can be retried
+func (s *PrometheusSink) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("Unable to create request: %v", err)
+	}
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "net-monitor-pinger")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("Unable to POST samples: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		//server errors and rate limiting are retryable, other client errors aren't
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("Unexpected status: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return false, nil
+}
+
+func (s *PrometheusSink) WritePings(pings []*Ping) error {
+	body := snappy.Encode(nil, encodeWriteRequest(s.series(pings)))
+
+	backoff := remoteWriteMinBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= s.retries {
+			return err
+		}
+
+		log.Printf("PrometheusSink: Write failed, retrying in %v: %v\n", backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > remoteWriteMaxBackoff {
+			backoff = remoteWriteMaxBackoff
+		}
+	}
+}
+
+func (s *PrometheusSink) WriteEvents(events []*Event) error {
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+//protoFields decodes the fields of a protobuf message. Length-delimited fields are returned as []byte, fixed64
+//fields as uint64, and varints as uint64
+func protoFields(buf []byte) (map[int][]interface{}, error) {
+	fields := make(map[int][]interface{})
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, fmt.Errorf("Invalid tag")
+		}
+		buf = buf[n:]
+
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return nil, fmt.Errorf("Invalid varint")
+			}
+			fields[field] = append(fields[field], v)
+			buf = buf[n:]
+		case wireFixed64:
+			if len(buf) < 8 {
+				return nil, fmt.Errorf("Invalid fixed64")
+			}
+			fields[field] = append(fields[field], binary.LittleEndian.Uint64(buf))
+			buf = buf[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < l {
+				return nil, fmt.Errorf("Invalid length")
+			}
+			fields[field] = append(fields[field], buf[n:n+int(l)])
+			buf = buf[n+int(l):]
+		default:
+			return nil, fmt.Errorf("Unknown wire type: %d", tag&7)
+		}
+	}
+	return fields, nil
+}
+
+//decodeWriteRequest decodes a prometheus.WriteRequest into series keyed by their labels in the form
+//name{k="v",...}, with samples in the form value@timestamp
+func decodeWriteRequest(buf []byte) (map[string][]string, error) {
+	req, err := protoFields(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	series := make(map[string][]string)
+	for _, ts := range req[1] {
+		fields, err := protoFields(ts.([]byte))
+		if err != nil {
+			return nil, err
+		}
+
+		var name string
+		labels := make([]string, 0)
+		for _, l := range fields[1] {
+			lf, err := protoFields(l.([]byte))
+			if err != nil {
+				return nil, err
+			}
+			k, v := string(lf[1][0].([]byte)), string(lf[2][0].([]byte))
+			if k == "__name__" {
+				name = v
+				continue
+			}
+			labels = append(labels, fmt.Sprintf("%s=%q", k, v))
+		}
+		key := name + "{" + strings.Join(labels, ",") + "}"
+
+		for _, s := range fields[2] {
+			sf, err := protoFields(s.([]byte))
+			if err != nil {
+				return nil, err
+			}
+			value := math.Float64frombits(sf[1][0].(uint64))
+			series[key] = append(series[key], fmt.Sprintf("%g@%d", value, int64(sf[2][0].(uint64))))
+		}
+	}
+	return series, nil
+}
+
+func TestPrometheusSink(t *testing.T) {
+	type request struct {
+		headers http.Header
+		series  map[string][]string
+	}
+	reqs := make(chan *request, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		buf, err := snappy.Decode(nil, body)
+		if err != nil {
+			t.Errorf("Unable to decode snappy body: %v", err)
+		}
+		series, err := decodeWriteRequest(buf)
+		if err != nil {
+			t.Errorf("Unable to decode WriteRequest: %v", err)
+		}
+		reqs <- &request{headers: r.Header, series: series}
+	}))
+	defer srv.Close()
+
+	s, err := NewPrometheusSink(srv.URL, map[string]string{"X-Scope-OrgID": "site1"}, 0)
+	if err != nil {
+		t.Fatalf("Unable to create PrometheusSink: %v", err)
+	}
+
+	d := testDevice("1", "router")
+	d.DeviceType = &DeviceType{ID: "t", Name: "Switch"}
+	ip := net.ParseIP("192.0.2.1")
+	start := time.Unix(1600000000, 0)
+	//out of order within the batch
+	pings := []*Ping{
+		{Device: d, IP: ip, SentTime: start.Add(5 * time.Second), Sent: 4, Received: 4, AvgRTT: 2 * time.Millisecond},
+		{Device: d, IP: ip, SentTime: start, Sent: 4, Received: 3, Loss: 25, AvgRTT: time.Millisecond},
+		{Device: d, IP: ip, SentTime: start.Add(10 * time.Second), Sent: 4, Received: 0, Loss: 100},
+	}
+	if err = s.WritePings(pings); err != nil {
+		t.Fatalf("Unable to write Pings: %v", err)
+	}
+
+	r := <-reqs
+	for k, v := range map[string]string{
+		"Content-Encoding":                  "snappy",
+		"Content-Type":                      "application/x-protobuf",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+		"X-Scope-OrgID":                     "site1",
+	} {
+		if got := r.headers.Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+
+	labels := `{device_id="1",device_type="Switch",hostname="router",ip="192.0.2.1"}`
+	want := map[string]string{
+		"net_monitor_ping_loss_ratio" + labels:  "0.25@1600000000000 0@1600000005000 1@1600000010000",
+		"net_monitor_ping_rtt_seconds" + labels: "0.001@1600000000000 0.002@1600000005000",
+	}
+	if len(r.series) != len(want) {
+		t.Errorf("series = %v, want %d series", r.series, len(want))
+	}
+	for k, v := range want {
+		if got := strings.Join(r.series[k], " "); got != v {
+			t.Errorf("%s = %s, want %s", k, got, v)
+		}
+	}
+}
+
+func TestPrometheusSinkRetry(t *testing.T) {
+	statuses := make(chan int, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(<-statuses)
+	}))
+	defer srv.Close()
+
+	s, err := NewPrometheusSink(srv.URL, nil, 1)
+	if err != nil {
+		t.Fatalf("Unable to create PrometheusSink: %v", err)
+	}
+	pings := []*Ping{{Device: testDevice("1", "router"), IP: net.ParseIP("192.0.2.1"), SentTime: time.Now(), Sent: 1}}
+
+	tests := []struct {
+		statuses []int
+		err      bool
+	}{
+		{[]int{http.StatusServiceUnavailable, http.StatusOK}, false},
+		{[]int{http.StatusTooManyRequests, http.StatusTooManyRequests}, true},
+		//out of order samples are rejected with a 400, which isn't retried
+		{[]int{http.StatusBadRequest}, true},
+	}
+	for _, test := range tests {
+		for _, st := range test.statuses {
+			statuses <- st
+		}
+		if err = s.WritePings(pings); (err != nil) != test.err {
+			t.Errorf("%v: err = %v, want error: %v", test.statuses, err, test.err)
+		}
+		if len(statuses) != 0 {
+			t.Errorf("%v: %d requests not made", test.statuses, len(statuses))
+			for len(statuses) > 0 {
+				<-statuses
+			}
+		}
+	}
+}
+
+func TestPrometheusSinkOrdered(t *testing.T) {
+	s, err := NewPrometheusSink("http://127.0.0.1:9090/api/v1/push", nil, 0)
+	if err != nil {
+		t.Fatalf("Unable to create PrometheusSink: %v", err)
+	}
+	w, err := newSinkWriter(s, NewMetrics(), time.Hour, 10, 10, 4, OverflowDropOldest)
+	if err != nil {
+		t.Fatalf("Unable to create sinkWriter: %v", err)
+	}
+	if cap(w.inflight) != 1 {
+		t.Errorf("concurrency = %d, want 1", cap(w.inflight))
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+//lagWarning is the scheduling lag above which the Scheduler logs a warning
+const lagWarning = time.Second
+
+//scheduled is a Device in the Scheduler's wheel
+type scheduled struct {
+	device   *Device
+	interval time.Duration
+	next     time.Time
+	rounds   int
+	removed  bool
+}
+
+//Scheduler is a hashed timer wheel that fires each Device at a fixed cadence. Each Device is given a deterministic
+//phase offset into its interval based on a hash of its ID, so pings are spread evenly across the interval instead
+//of being sent in a single burst. Run times are computed from the phase, not from the last run, so they don't drift
+type Scheduler struct {
+	tick    time.Duration
+	slots   [][]*scheduled
+	pos     int
+	current time.Time
+
+	entries map[string]*scheduled
+	mu      *sync.Mutex
+
+	fire func(d *Device)
+
+	lag     time.Duration
+	maxLag  time.Duration
+	lastRun time.Time
+	lagMu   *sync.Mutex
+}
+
+//NewScheduler returns a new Scheduler with the given tick resolution and number of slots in the wheel.
+//fire is called with each Device when it's due
+func NewScheduler(tick time.Duration, slots int, fire func(d *Device)) *Scheduler {
+	s := &Scheduler{
+		tick:    tick,
+		slots:   make([][]*scheduled, slots),
+		current: time.Now(),
+		entries: make(map[string]*scheduled),
+		mu:      new(sync.Mutex),
+		fire:    fire,
+		lastRun: time.Now(),
+		lagMu:   new(sync.Mutex),
+	}
+	log.Printf("Scheduler: Starting with %v resolution and %d slots\n", tick, slots)
+	go s.run()
+	return s
+}
+
+//phase returns the deterministic offset of id into interval
+func phase(id string, interval time.Duration) time.Duration {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return time.Duration(h.Sum64() % uint64(interval))
+}
+
+//insert places e in the wheel based on e.next. mu must be held
+func (s *Scheduler) insert(e *scheduled) {
+	ticks := int((e.next.Sub(s.current) + s.tick - 1) / s.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	idx := (s.pos + ticks) % len(s.slots)
+	e.rounds = (ticks - 1) / len(s.slots)
+	s.slots[idx] = append(s.slots[idx], e)
+}
+
+//Add schedules d to be fired every interval, replacing any existing schedule for d. An error is returned if interval
+//isn't positive
+func (s *Scheduler) Add(d *Device, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("Invalid interval: %v", interval)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[d.ID]; ok {
+		e.removed = true
+	}
+
+	now := time.Now()
+	next := now.Truncate(interval).Add(phase(d.ID, interval))
+	if next.Before(now) {
+		next = next.Add(interval)
+	}
+
+	e := &scheduled{device: d, interval: interval, next: next}
+	s.entries[d.ID] = e
+	s.insert(e)
+	return nil
+}
+
+//Remove stops firing the Device with the given id
+func (s *Scheduler) Remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[id]; ok {
+		e.removed = true
+		delete(s.entries, id)
+	}
+}
+
+//advance moves the wheel forward to now and returns the entries that are due. mu must be held
+func (s *Scheduler) advance(now time.Time) []*scheduled {
+	due := make([]*scheduled, 0)
+	for !s.current.Add(s.tick).After(now) {
+		s.current = s.current.Add(s.tick)
+		s.pos = (s.pos + 1) % len(s.slots)
+
+		slot := s.slots[s.pos]
+		s.slots[s.pos] = nil
+		for _, e := range slot {
+			if e.removed {
+				continue
+			}
+			if e.rounds > 0 {
+				e.rounds--
+				s.slots[s.pos] = append(s.slots[s.pos], e)
+				continue
+			}
+			due = append(due, e)
+		}
+	}
+	return due
+}
+
+func (s *Scheduler) run() {
+	t := time.NewTicker(s.tick)
+	defer t.Stop()
+
+	for now := range t.C {
+		s.mu.Lock()
+		due := s.advance(now)
+		sort.Slice(due, func(i, j int) bool { return due[i].next.Before(due[j].next) })
+
+		type firing struct {
+			device *Device
+			next   time.Time
+		}
+		fired := make([]firing, 0, len(due))
+		for _, e := range due {
+			fired = append(fired, firing{device: e.device, next: e.next})
+
+			//keep a fixed cadence, skipping runs that were missed entirely
+			for !e.next.After(now) {
+				e.next = e.next.Add(e.interval)
+			}
+			s.insert(e)
+		}
+		s.mu.Unlock()
+
+		for _, f := range fired {
+			s.recordLag(time.Since(f.next))
+			s.fire(f.device)
+		}
+
+		s.lagMu.Lock()
+		s.lastRun = time.Now()
+		s.lagMu.Unlock()
+	}
+}
+
+func (s *Scheduler) recordLag(lag time.Duration) {
+	if lag < 0 {
+		lag = 0
+	}
+	s.lagMu.Lock()
+	s.lag = lag
+	if lag > s.maxLag {
+		s.maxLag = lag
+	}
+	s.lagMu.Unlock()
+
+	if lag > lagWarning {
+		log.Println("Scheduler: Running behind by", lag)
+	}
+}
+
+//Lag returns the most recent scheduling lag (the time between when a Device was due and when it was fired)
+//and the maximum lag since the last call to Lag
+func (s *Scheduler) Lag() (last, max time.Duration) {
+	s.lagMu.Lock()
+	defer s.lagMu.Unlock()
+	last, max = s.lag, s.maxLag
+	s.maxLag = 0
+	return last, max
+}
+
+//SchedulerStatus is the status of a Scheduler
+type SchedulerStatus struct {
+	//LastRun is when the Scheduler last finished firing due Devices
+	LastRun   time.Time `json:"last_run"`
+	Scheduled int       `json:"scheduled"`
+}
+
+//Status returns the current status of the Scheduler
+func (s *Scheduler) Status() *SchedulerStatus {
+	s.mu.Lock()
+	scheduled := len(s.entries)
+	s.mu.Unlock()
+
+	s.lagMu.Lock()
+	defer s.lagMu.Unlock()
+	return &SchedulerStatus{LastRun: s.lastRun, Scheduled: scheduled}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testScheduler returns a Scheduler that isn't running, so the wheel can be advanced manually
+func testScheduler(tick time.Duration, slots int) *Scheduler {
+	return &Scheduler{
+		tick:    tick,
+		slots:   make([][]*scheduled, slots),
+		current: time.Now(),
+		entries: make(map[string]*scheduled),
+		mu:      new(sync.Mutex),
+		lagMu:   new(sync.Mutex),
+	}
+}
+
+func TestSchedulerInsert(t *testing.T) {
+	tests := []struct {
+		pos    int
+		offset time.Duration
+		ticks  int
+		slot   int
+		rounds int
+	}{
+		{0, -time.Second, 1, 1, 0},
+		{0, 0, 1, 1, 0},
+		{0, 50 * time.Millisecond, 1, 1, 0},
+		{0, 100 * time.Millisecond, 1, 1, 0},
+		{0, 101 * time.Millisecond, 2, 2, 0},
+		{0, 900 * time.Millisecond, 9, 9, 0},
+		{0, time.Second, 10, 0, 0},
+		{0, 1001 * time.Millisecond, 11, 1, 1},
+		{0, 2500 * time.Millisecond, 25, 5, 2},
+		{7, 300 * time.Millisecond, 3, 0, 0},
+		{7, 2500 * time.Millisecond, 25, 2, 2},
+	}
+
+	for _, test := range tests {
+		name := fmt.Sprintf("pos %d, offset %v", test.pos, test.offset)
+		s := testScheduler(100*time.Millisecond, 10)
+		s.pos = test.pos
+		e := &scheduled{device: testDevice("1", "router"), next: s.current.Add(test.offset)}
+		s.insert(e)
+
+		if e.rounds != test.rounds {
+			t.Errorf("%s: rounds = %d, want %d", name, e.rounds, test.rounds)
+		}
+		if len(s.slots[test.slot]) != 1 {
+			t.Errorf("%s: not inserted in slot %d", name, test.slot)
+		}
+
+		//the entry is due after exactly ticks ticks
+		now := s.current
+		for i := 1; i <= test.ticks; i++ {
+			now = now.Add(s.tick)
+			due := s.advance(now)
+			if i < test.ticks && len(due) != 0 {
+				t.Errorf("%s: due after %d ticks, want %d", name, i, test.ticks)
+				break
+			}
+			if i == test.ticks && len(due) != 1 {
+				t.Errorf("%s: not due after %d ticks", name, test.ticks)
+			}
+		}
+	}
+}
+
+func TestSchedulerAdvanceSkipsRemoved(t *testing.T) {
+	s := testScheduler(100*time.Millisecond, 10)
+	for _, id := range []string{"1", "2"} {
+		if err := s.Add(testDevice(id, id), time.Hour); err != nil {
+			t.Fatalf("Unable to add Device %s: %v", id, err)
+		}
+	}
+	s.Remove("1")
+
+	due := s.advance(s.current.Add(time.Hour + s.tick))
+	if len(due) != 1 || due[0].device.ID != "2" {
+		t.Errorf("due = %d entries, want only Device 2", len(due))
+	}
+}
+
+func TestSchedulerAdd(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		err      bool
+	}{
+		{-time.Second, true},
+		{0, true},
+		{time.Second, false},
+		{time.Minute, false},
+	}
+
+	for _, test := range tests {
+		s := testScheduler(100*time.Millisecond, 10)
+		d := testDevice("1", "router")
+		err := s.Add(d, test.interval)
+		if (err != nil) != test.err {
+			t.Errorf("%v: err = %v, want error: %v", test.interval, err, test.err)
+			continue
+		}
+		if test.err {
+			if len(s.entries) != 0 {
+				t.Errorf("%v: Device scheduled with invalid interval", test.interval)
+			}
+			continue
+		}
+
+		//the next run is within one interval, at the Device's phase offset
+		e := s.entries[d.ID]
+		if until := time.Until(e.next); until < 0 || until > test.interval {
+			t.Errorf("%v: next run in %v, want within one interval", test.interval, until)
+		}
+		if offset := e.next.Sub(e.next.Truncate(test.interval)); offset != phase(d.ID, test.interval) {
+			t.Errorf("%v: offset = %v, want %v", test.interval, offset, phase(d.ID, test.interval))
+		}
+
+		//adding again replaces the existing schedule
+		old := e
+		if err = s.Add(d, test.interval); err != nil {
+			t.Fatalf("%v: Unable to re-add Device: %v", test.interval, err)
+		}
+		if !old.removed || s.entries[d.ID] == old {
+			t.Errorf("%v: existing schedule not replaced", test.interval)
+		}
+	}
+}
+
+func TestPhase(t *testing.T) {
+	interval := time.Minute
+	buckets := make([]int, 6)
+	for i := 0; i < 600; i++ {
+		id := fmt.Sprintf("device-%d", i)
+		p := phase(id, interval)
+		if p < 0 || p >= interval {
+			t.Fatalf("phase(%s) = %v, want within [0, %v)", id, p, interval)
+		}
+		if p != phase(id, interval) {
+			t.Fatalf("phase(%s) isn't deterministic", id)
+		}
+		buckets[p/(interval/6)]++
+	}
+
+	//phases are spread across the interval
+	for i, n := range buckets {
+		if n < 50 || n > 150 {
+			t.Errorf("bucket %d has %d of 600 Devices, want about 100", i, n)
+		}
+	}
+}
+
+func TestSchedulerRun(t *testing.T) {
+	fired := make(chan time.Time, 100)
+	s := NewScheduler(10*time.Millisecond, 16, func(d *Device) { fired <- time.Now() })
+	if err := s.Add(testDevice("1", "router"), 100*time.Millisecond); err != nil {
+		t.Fatalf("Unable to add Device: %v", err)
+	}
+
+	times := make([]time.Time, 0)
+	timeout := time.After(2 * time.Second)
+	for len(times) < 4 {
+		select {
+		case f := <-fired:
+			times = append(times, f)
+		case <-timeout:
+			t.Fatalf("Fired %d times, want 4", len(times))
+		}
+	}
+	s.Remove("1")
+
+	for i := 1; i < len(times); i++ {
+		if d := times[i].Sub(times[i-1]); d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Errorf("run %d was %v after the previous run, want about 100ms", i, d)
+		}
+	}
+	if st := s.Status(); time.Since(st.LastRun) > time.Second || st.Scheduled != 0 {
+		t.Errorf("status = %+v, want a recent run and no Devices", st)
+	}
+}
@@ -16,13 +16,19 @@ RETURNS SETOF ping_aggregate_template AS $$
     SELECT
         device_id,
         ip,
-        COUNT(*) AS total,
-        SUM(CASE WHEN rtt IS NULL THEN 1 ELSE 0 END) AS lost,
-        CAST(SUM(CASE WHEN rtt IS NULL THEN 1 ELSE 0 END) * 100 / CAST(COUNT(*) AS NUMERIC(6, 2)) AS NUMERIC(6, 2)) AS loss_pct,
-        CAST(MAX(rtt) AS NUMERIC(6, 2)) AS max,
-        CAST(MIN(rtt) AS NUMERIC(6, 2)) AS min,
-        CAST(AVG(rtt) AS NUMERIC(6, 2)) AS avg,
-        CAST(STDDEV(rtt) AS NUMERIC(6, 2)) AS stddev
+        SUM(probes) AS total,
+        SUM(lost) AS lost,
+        CAST(SUM(lost) * 100 / CAST(SUM(probes) AS NUMERIC) AS NUMERIC(6, 2)) AS loss_pct,
+        CAST(MAX(rtt_max) AS NUMERIC(6, 2)) AS max,
+        CAST(MIN(rtt_min) AS NUMERIC(6, 2)) AS min,
+        -- avg and stddev are over every received probe, pooled from each burst's received count (probes - lost),
+        -- average (rtt), and standard deviation (rtt_stddev)
+        CAST(SUM((probes - lost) * rtt) / CAST(NULLIF(SUM(probes - lost), 0) AS NUMERIC) AS NUMERIC(6, 2)) AS avg,
+        CAST(CASE WHEN SUM(probes - lost) > 1 THEN SQRT(GREATEST(0,
+            (SUM((probes - lost - 1) * rtt_stddev ^ 2) + SUM((probes - lost) * rtt ^ 2) -
+                SUM((probes - lost) * rtt) ^ 2 / SUM(probes - lost)) /
+            (SUM(probes - lost) - 1)
+        )) END AS NUMERIC(6, 2)) AS stddev
     FROM ping
     WHERE device_row.id = device_id AND
         sent_time > (NOW() AT TIME ZONE 'UTC') - duration
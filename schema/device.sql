@@ -1,6 +1,10 @@
 CREATE TABLE device_type (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-    name VARCHAR NOT NULL UNIQUE CHECK (0 < char_length(name) AND char_length(name) < 256)
+    name VARCHAR NOT NULL UNIQUE CHECK (0 < char_length(name) AND char_length(name) < 256),
+    ping_interval INTEGER CHECK (0 < ping_interval),
+    ping_timeout INTEGER CHECK (0 < ping_timeout),
+    ping_count SMALLINT CHECK (0 < ping_count),
+    ping_enabled BOOLEAN
 );
 
 INSERT INTO device_type (name) VALUES ('Server'), ('Switch');
@@ -9,5 +13,21 @@ CREATE TABLE device (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     device_type_id UUID NOT NULL,
     hostname VARCHAR NOT NULL UNIQUE CHECK (0 < char_length(hostname) AND char_length(hostname) < 256),
-    FOREIGN KEY (device_type_id) REFERENCES device_type(id)
+    ping_interval INTEGER CHECK (0 < ping_interval),
+    ping_timeout INTEGER CHECK (0 < ping_timeout),
+    ping_count SMALLINT CHECK (0 < ping_count),
+    ping_enabled BOOLEAN,
+    parent_device_id UUID CHECK (parent_device_id <> id),
+    no_dns BOOLEAN NOT NULL DEFAULT FALSE,
+    subnet CIDR,
+    nameservers VARCHAR,
+    FOREIGN KEY (device_type_id) REFERENCES device_type(id),
+    FOREIGN KEY (parent_device_id) REFERENCES device(id) ON DELETE SET NULL
+);
+
+CREATE TABLE device_ip (
+    device_id UUID NOT NULL,
+    ip INET NOT NULL,
+    PRIMARY KEY (device_id, ip),
+    FOREIGN KEY (device_id) REFERENCES device(id) ON DELETE CASCADE
 );
@@ -0,0 +1,11 @@
+CREATE TABLE discovered_host (
+    device_id UUID NOT NULL,
+    ip INET NOT NULL,
+    live BOOLEAN NOT NULL,
+    first_seen TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+    last_change TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+    PRIMARY KEY (device_id, ip),
+    FOREIGN KEY (device_id) REFERENCES device(id) ON DELETE CASCADE
+);
+
+CREATE INDEX discovered_host_live ON discovered_host (device_id, live);
@@ -0,0 +1,13 @@
+CREATE TABLE device_event (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    device_id UUID NOT NULL,
+    ip INET,
+    time TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+    previous_state VARCHAR NOT NULL CHECK (previous_state IN ('unknown', 'up', 'degraded', 'down', 'unreachable')),
+    state VARCHAR NOT NULL CHECK (state IN ('unknown', 'up', 'degraded', 'down', 'unreachable')),
+    flapping BOOLEAN NOT NULL DEFAULT FALSE,
+    planned BOOLEAN NOT NULL DEFAULT FALSE,
+    FOREIGN KEY (device_id) REFERENCES device(id) ON DELETE CASCADE
+);
+
+CREATE INDEX device_event_device_id_time ON device_event (device_id, time);
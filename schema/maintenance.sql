@@ -0,0 +1,12 @@
+CREATE TABLE maintenance_window (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    device_id UUID,
+    device_type_id UUID,
+    start_time TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+    end_time TIMESTAMP WITHOUT TIME ZONE NOT NULL CHECK (start_time < end_time),
+    recurrence VARCHAR NOT NULL DEFAULT 'none' CHECK (recurrence IN ('none', 'daily', 'weekly', 'monthly')),
+    description VARCHAR,
+    CHECK (device_id IS NULL OR device_type_id IS NULL),
+    FOREIGN KEY (device_id) REFERENCES device(id) ON DELETE CASCADE,
+    FOREIGN KEY (device_type_id) REFERENCES device_type(id) ON DELETE CASCADE
+);
@@ -3,6 +3,13 @@ CREATE TABLE ping (
     ip INET NOT NULL,
     sent_time TIMESTAMP WITHOUT TIME ZONE NOT NULL,
     rtt INTEGER,
+    probes SMALLINT NOT NULL DEFAULT 1 CHECK (0 < probes),
+    lost SMALLINT NOT NULL DEFAULT 0 CHECK (0 <= lost AND lost <= probes),
+    rtt_min NUMERIC(9, 3),
+    rtt_max NUMERIC(9, 3),
+    rtt_stddev NUMERIC(9, 3),
+    jitter NUMERIC(9, 3),
+    planned BOOLEAN NOT NULL DEFAULT FALSE,
     PRIMARY KEY (device_id, sent_time),
     FOREIGN KEY (device_id) REFERENCES device(id) ON DELETE CASCADE
 );
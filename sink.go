@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+//ResultSink is a destination for Pings and Events. Sinks that don't store Events should return nil from WriteEvents
+type ResultSink interface {
+	Name() string
+	WritePings(pings []*Ping) error
+	WriteEvents(events []*Event) error
+}
+
+//Spooler is a ResultSink that can spool results when its buffer is full
+type Spooler interface {
+	Spool(pings []*Ping, events []*Event)
+}
+
+//Ordered is a ResultSink that requires results to be written in order, so its writes are never concurrent
+type Ordered interface {
+	Ordered()
+}
+
+//sinkWriter buffers results for a ResultSink and writes them in batches. Each sink has its own buffer and writer so a
+//slow or failing sink doesn't affect the others
+type sinkWriter struct {
+	sink ResultSink
+	b    *resultBuffer
+	x    *Metrics
+
+	//batch is the maximum number of Pings or Events per write
+	batch int
+	//inflight limits the number of concurrent writes
+	inflight chan struct{}
+}
+
+//newSinkWriter returns a new sinkWriter for sink and starts writing every interval. If policy is OverflowSpool, sink
+//must be a Spooler
+func newSinkWriter(sink ResultSink, x *Metrics, interval time.Duration, batch, buffer, concurrency int, policy OverflowPolicy) (*sinkWriter, error) {
+	if batch < 1 {
+		return nil, fmt.Errorf("Invalid batch size: %d", batch)
+	}
+	if concurrency < 1 {
+		return nil, fmt.Errorf("Invalid concurrency: %d", concurrency)
+	}
+
+	if _, ok := sink.(Ordered); ok && concurrency > 1 {
+		log.Printf("Manager: %s requires ordered writes, using a concurrency of 1\n", sink.Name())
+		concurrency = 1
+	}
+
+	var overflow func(pings []*Ping, events []*Event)
+	if s, ok := sink.(Spooler); ok {
+		overflow = s.Spool
+	} else if policy == OverflowSpool {
+		log.Printf("Manager: %s can't spool, using %s overflow policy\n", sink.Name(), OverflowDropOldest)
+		policy = OverflowDropOldest
+	}
+	b, err := newResultBuffer(buffer, policy, overflow)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create buffer: %v", err)
+	}
+
+	w := &sinkWriter{sink: sink, b: b, x: x, batch: batch, inflight: make(chan struct{}, concurrency)}
+
+	name := sink.Name()
+	x.Gauge("net_monitor_buffered_pings", "Pings waiting to be written.", func() float64 {
+		pings, _ := w.b.Len()
+		return float64(pings)
+	}, "sink", name)
+	x.Gauge("net_monitor_buffered_events", "Events waiting to be written.", func() float64 {
+		_, events := w.b.Len()
+		return float64(events)
+	}, "sink", name)
+	x.Counter("net_monitor_dropped_pings_total", "Pings dropped because the buffer was full.", func() float64 {
+		pings, _ := w.b.Dropped()
+		return float64(pings)
+	}, "sink", name)
+	x.Counter("net_monitor_dropped_events_total", "Events dropped because the buffer was full.", func() float64 {
+		_, events := w.b.Dropped()
+		return float64(events)
+	}, "sink", name)
+	x.Gauge("net_monitor_inflight_writes", "Writes in progress.", func() float64 {
+		return float64(len(w.inflight))
+	}, "sink", name)
+
+	log.Printf("Manager: Writing results to %s in batches of %d\n", name, batch)
+	go w.writer(interval)
+
+	return w, nil
+}
+
+func (w *sinkWriter) writer(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		w.flush()
+	}
+}
+
+//flush writes buffered results in batches. If the limit of concurrent writes is reached, flush waits for a write
+//to finish, and new results wait in the buffer
+func (w *sinkWriter) flush() {
+	for {
+		w.inflight <- struct{}{}
+		pings, events := w.b.Take(w.batch)
+		if len(pings) == 0 && len(events) == 0 {
+			<-w.inflight
+			return
+		}
+
+		go func() {
+			defer func() { <-w.inflight }()
+			w.write(pings, events)
+		}()
+
+		if len(pings) < w.batch && len(events) < w.batch {
+			return
+		}
+	}
+}
+
+func (w *sinkWriter) write(pings []*Ping, events []*Event) {
+	if len(pings) > 0 {
+		start := time.Now()
+		err := w.sink.WritePings(pings)
+		w.x.ObserveWrite(w.sink.Name(), time.Since(start), err)
+		if err != nil {
+			log.Printf("Manager: Failed to write Pings to %s: %v\n", w.sink.Name(), err)
+		}
+	}
+
+	if len(events) > 0 {
+		if err := w.sink.WriteEvents(events); err != nil {
+			log.Printf("Manager: Failed to write Events to %s: %v\n", w.sink.Name(), err)
+		}
+	}
+}
+
+//spooled is a batch of rows that failed to insert
+type spooled struct {
+	Pings  []*pingRow  `json:"pings,omitempty"`
+	Events []*eventRow `json:"events,omitempty"`
+}
+
+//GraphQLSink is a ResultSink that inserts results with the GraphQLService. If a Spool is configured, batches that
+//fail to insert are spooled and replayed while the GraphQLService is connected
+type GraphQLSink struct {
+	g     *GraphQLService
+	q     *Spool
+	batch int
+}
+
+//NewGraphQLSink returns a new GraphQLSink. If q isn't nil, failed batches are spooled to it in batches of batch,
+//and replayed every interval
+func NewGraphQLSink(g *GraphQLService, q *Spool, batch int, interval time.Duration) *GraphQLSink {
+	s := &GraphQLSink{g: g, q: q, batch: batch}
+	if q != nil {
+		go s.replayer(interval)
+	}
+	return s
+}
+
+func (s *GraphQLSink) Name() string {
+	return "graphql"
+}
+
+func (s *GraphQLSink) WritePings(pings []*Ping) error {
+	if err := s.g.InsertPings(pings); err != nil {
+		//rejected batches would be rejected again when replayed
+		if !isPermanent(err) {
+			s.spool(&spooled{Pings: newPingRows(pings)})
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *GraphQLSink) WriteEvents(events []*Event) error {
+	//the same rows are spooled, so Events that were inserted before the error aren't inserted again when replayed
+	rows := newEventRows(events)
+	if err := s.g.insertEventRows(rows, false); err != nil {
+		if !isPermanent(err) {
+			s.spool(&spooled{Events: rows})
+		}
+		return err
+	}
+	return nil
+}
+
+//Spool spools results from a full buffer in batches
+func (s *GraphQLSink) Spool(pings []*Ping, events []*Event) {
+	log.Printf("GraphQLSink: Buffer full, spooling %d Pings and %d Events\n", len(pings), len(events))
+	for i := 0; i < len(pings); i += s.batch {
+		end := i + s.batch
+		if end > len(pings) {
+			end = len(pings)
+		}
+		s.spool(&spooled{Pings: newPingRows(pings[i:end])})
+	}
+	for i := 0; i < len(events); i += s.batch {
+		end := i + s.batch
+		if end > len(events) {
+			end = len(events)
+		}
+		s.spool(&spooled{Events: newEventRows(events[i:end])})
+	}
+}
+
+//spool writes a batch to the Spool, if enabled
+func (s *GraphQLSink) spool(sp *spooled) {
+	if s.q == nil {
+		return
+	}
+
+	buf, err := json.Marshal(sp)
+	if err != nil {
+		log.Println("GraphQLSink: Unable to marshal spooled batch:", err)
+		return
+	}
+	if err = s.q.Append(buf); err != nil {
+		log.Println("GraphQLSink: Unable to spool batch:", err)
+	}
+}
+
+//replayer inserts spooled batches, oldest first, while the GraphQLService is connected
+func (s *GraphQLSink) replayer(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if s.q.Size() == 0 || !s.g.Status().Connected {
+			continue
+		}
+
+		n, err := s.q.Replay(func(buf []byte) error {
+			sp := new(spooled)
+			if err := json.Unmarshal(buf, sp); err != nil {
+				//a record that can't be parsed will never succeed, so skip it
+				log.Println("GraphQLSink: Unable to unmarshal spooled batch, skipping:", err)
+				return nil
+			}
+			var err error
+			if len(sp.Pings) > 0 {
+				err = s.g.insertPingRows(sp.Pings, true)
+			}
+			if err == nil && len(sp.Events) > 0 {
+				err = s.g.insertEventRows(sp.Events, true)
+			}
+			//a batch that was rejected (e.g. its Device was deleted) will never succeed, so drop it instead of
+			//blocking the batches after it. Other errors (e.g. a disconnect) stop the replay until the next attempt
+			if isPermanent(err) {
+				log.Printf("GraphQLSink: Dropping spooled batch of %d Pings and %d Events: %v\n", len(sp.Pings), len(sp.Events), err)
+				return nil
+			}
+			return err
+		})
+		if n > 0 {
+			log.Println("GraphQLSink: Replayed", n, "spooled batches")
+		}
+		if err != nil {
+			log.Println("GraphQLSink: Unable to replay spooled batches:", err)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//smtpMaxDigest is the maximum number of Alerts queued for a recipient's digest. Older Alerts are dropped past it
+const smtpMaxDigest = 1000
+
+//SMTPNotifier is a Notifier that emails Alerts. Recipients are chosen by the Device's type. Alerts for critical
+//device types are sent immediately; all others are batched into a periodic digest per recipient
+type SMTPNotifier struct {
+	addr     string
+	host     string
+	auth     smtp.Auth
+	startTLS bool
+	from     string
+
+	//routes maps device type names to recipients. Recipients for "*" receive Alerts for every device type
+	routes   map[string][]string
+	critical map[string]struct{}
+
+	//digest holds queued Alerts by recipient, oldest first
+	digest   map[string][]*Alert
+	digestMu *sync.Mutex
+
+	tls *tls.Config
+}
+
+//NewSMTPNotifier returns a new SMTPNotifier. routes maps device type names (or "*") to semicolon-separated recipients.
+//Alerts for devices with a type in critical are sent immediately, and all others are sent every digest
+func NewSMTPNotifier(host string, port int, username, password, from string, startTLS bool, routes map[string]string, critical []string, digest time.Duration) (*SMTPNotifier, error) {
+	if from == "" {
+		return nil, fmt.Errorf("From address is required")
+	}
+	if digest <= 0 {
+		return nil, fmt.Errorf("Invalid digest interval: %v", digest)
+	}
+
+	s := &SMTPNotifier{
+		addr:     net.JoinHostPort(host, strconv.Itoa(port)),
+		host:     host,
+		startTLS: startTLS,
+		from:     from,
+		routes:   make(map[string][]string),
+		critical: make(map[string]struct{}),
+		digest:   make(map[string][]*Alert),
+		digestMu: new(sync.Mutex),
+		tls:      &tls.Config{ServerName: host},
+	}
+
+	if username != "" {
+		s.auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	for typ, rcpts := range routes {
+		for _, r := range strings.Split(rcpts, ";") {
+			if r = strings.TrimSpace(r); r != "" {
+				s.routes[typ] = append(s.routes[typ], r)
+			}
+		}
+	}
+	if len(s.routes) == 0 {
+		return nil, fmt.Errorf("At least one recipient is required")
+	}
+
+	for _, typ := range critical {
+		s.critical[typ] = struct{}{}
+	}
+
+	go s.digester(digest)
+
+	return s, nil
+}
+
+func (s *SMTPNotifier) Name() string {
+	return fmt.Sprintf("smtp (%s)", s.addr)
+}
+
+//deviceType returns the name of a's device type
+func deviceType(a *Alert) string {
+	if a.Device.DeviceType == nil {
+		return ""
+	}
+	return a.Device.DeviceType.Name
+}
+
+//recipients returns the recipients for a
+func (s *SMTPNotifier) recipients(a *Alert) []string {
+	seen := make(map[string]struct{})
+	rcpts := make([]string, 0)
+	for _, typ := range []string{deviceType(a), "*"} {
+		for _, r := range s.routes[typ] {
+			if _, ok := seen[r]; !ok {
+				seen[r] = struct{}{}
+				rcpts = append(rcpts, r)
+			}
+		}
+	}
+	return rcpts
+}
+
+//send sends an email with the given subject and body to rcpts
+func (s *SMTPNotifier) send(rcpts []string, subject, body string) (err error) {
+	conn, err := net.DialTimeout("tcp", s.addr, 30*time.Second)
+	if err != nil {
+		return fmt.Errorf("Unable to connect: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("Unable to create client: %v", err)
+	}
+	defer c.Close()
+
+	if s.startTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("Server does not support STARTTLS")
+		}
+		if err = c.StartTLS(s.tls); err != nil {
+			return fmt.Errorf("Unable to start TLS: %v", err)
+		}
+	}
+
+	if s.auth != nil {
+		if err = c.Auth(s.auth); err != nil {
+			return fmt.Errorf("Unable to authenticate: %v", err)
+		}
+	}
+
+	if err = c.Mail(s.from); err != nil {
+		return fmt.Errorf("Unable to set sender: %v", err)
+	}
+	for _, r := range rcpts {
+		if err = c.Rcpt(r); err != nil {
+			return fmt.Errorf("Unable to add recipient %s: %v", r, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("Unable to start message: %v", err)
+	}
+
+	msg := new(bytes.Buffer)
+	fmt.Fprintf(msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(rcpts, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	if _, err = w.Write(msg.Bytes()); err != nil {
+		return fmt.Errorf("Unable to write message: %v", err)
+	}
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("Unable to send message: %v", err)
+	}
+
+	return c.Quit()
+}
+
+//line returns a one line summary of a
+func line(a *Alert) string {
+	return fmt.Sprintf("%s: %s", a.Time.Local().Format("2006-01-02 15:04:05"), a.Message)
+}
+
+func (s *SMTPNotifier) Notify(a *Alert) error {
+	rcpts := s.recipients(a)
+	if len(rcpts) == 0 {
+		return nil
+	}
+
+	if _, ok := s.critical[deviceType(a)]; !ok {
+		s.digestMu.Lock()
+		for _, r := range rcpts {
+			s.queue(r, a)
+		}
+		s.digestMu.Unlock()
+		return nil
+	}
+
+	return s.send(rcpts, "[net-monitor] "+a.Message, line(a)+"\n")
+}
+
+//queue adds alerts to the digest for r, dropping the oldest Alerts if there are more than smtpMaxDigest.
+//s.digestMu must be held
+func (s *SMTPNotifier) queue(r string, alerts ...*Alert) {
+	q := append(s.digest[r], alerts...)
+	if n := len(q) - smtpMaxDigest; n > 0 {
+		log.Printf("SMTPNotifier: Digest for %s is full, dropping %d Alerts\n", r, n)
+		q = q[n:]
+	}
+	s.digest[r] = q
+}
+
+//digester sends queued Alerts every interval, batched by recipient. Alerts that fail to send are kept for the next digest
+func (s *SMTPNotifier) digester(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		s.digestMu.Lock()
+		batches := s.digest
+		s.digest = make(map[string][]*Alert)
+		s.digestMu.Unlock()
+
+		for r, batch := range batches {
+			sort.Slice(batch, func(i, j int) bool { return batch[i].Time.Before(batch[j].Time) })
+			body := new(strings.Builder)
+			for _, a := range batch {
+				body.WriteString(line(a) + "\n")
+			}
+
+			subject := fmt.Sprintf("[net-monitor] %d alerts", len(batch))
+			if err := s.send([]string{r}, subject, body.String()); err != nil {
+				log.Printf("SMTPNotifier: Unable to send digest to %s: %v\n", r, err)
+				s.digestMu.Lock()
+				newer := s.digest[r]
+				s.digest[r] = batch
+				s.queue(r, newer...)
+				s.digestMu.Unlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//smtpMessage is a message received by smtpServer
+type smtpMessage struct {
+	rcpts []string
+	data  string
+	tls   bool
+	auth  bool
+}
+
+//smtpServer is a minimal SMTP server supporting STARTTLS and AUTH PLAIN. The first fail messages are rejected
+type smtpServer struct {
+	l        net.Listener
+	tls      *tls.Config
+	username string
+	password string
+
+	msgs chan *smtpMessage
+
+	fail int
+	mu   *sync.Mutex
+}
+
+//newSMTPServer returns a running smtpServer and a client TLS config that trusts it
+func newSMTPServer(t *testing.T, username, password string, fail int) (*smtpServer, *tls.Config) {
+	//borrow httptest's certificate for 127.0.0.1
+	h := httptest.NewUnstartedServer(nil)
+	h.StartTLS()
+	cert := h.TLS.Certificates[0]
+	pool := x509.NewCertPool()
+	pool.AddCert(h.Certificate())
+	h.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+
+	s := &smtpServer{
+		l:        l,
+		tls:      &tls.Config{Certificates: []tls.Certificate{cert}},
+		username: username,
+		password: password,
+		msgs:     make(chan *smtpMessage, 100),
+		fail:     fail,
+		mu:       new(sync.Mutex),
+	}
+	go s.serve()
+
+	return s, &tls.Config{ServerName: "127.0.0.1", RootCAs: pool}
+}
+
+func (s *smtpServer) port() int {
+	return s.l.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpServer) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpServer) handle(conn net.Conn) {
+	defer func() { conn.Close() }()
+
+	tp := textproto.NewConn(conn)
+	msg := new(smtpMessage)
+	tp.PrintfLine("220 127.0.0.1 ESMTP")
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch cmd {
+		case "EHLO", "HELO":
+			if msg.tls {
+				tp.PrintfLine("250-127.0.0.1\r\n250 AUTH PLAIN")
+			} else {
+				tp.PrintfLine("250-127.0.0.1\r\n250-STARTTLS\r\n250 AUTH PLAIN")
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 Ready to start TLS")
+			tc := tls.Server(conn, s.tls)
+			if err = tc.Handshake(); err != nil {
+				return
+			}
+			conn, tp, msg.tls = tc, textproto.NewConn(tc), true
+		case "AUTH":
+			fields := strings.Fields(line)
+			cred, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+			if string(cred) != "\x00"+s.username+"\x00"+s.password {
+				tp.PrintfLine("535 Authentication failed")
+				continue
+			}
+			msg.auth = true
+			tp.PrintfLine("235 Authenticated")
+		case "MAIL":
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			msg.rcpts = append(msg.rcpts, strings.Trim(strings.SplitN(line, ":", 2)[1], "<> "))
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			buf, err := ioutil.ReadAll(tp.DotReader())
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			fail := s.fail > 0
+			s.fail--
+			s.mu.Unlock()
+			if fail {
+				tp.PrintfLine("451 Try again later")
+				continue
+			}
+			msg.data = string(buf)
+			s.msgs <- msg
+			msg = &smtpMessage{tls: msg.tls, auth: msg.auth}
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Unknown command")
+		}
+	}
+}
+
+//next returns the next message received, or nil if none is received within timeout
+func (s *smtpServer) next(timeout time.Duration) *smtpMessage {
+	select {
+	case m := <-s.msgs:
+		return m
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+//subject returns the Subject header of m
+func (m *smtpMessage) subject() string {
+	r, err := textproto.NewReader(bufio.NewReader(strings.NewReader(m.data))).ReadMIMEHeader()
+	if err != nil {
+		return ""
+	}
+	return r.Get("Subject")
+}
+
+func testAlert(typ, hostname string, t time.Time) *Alert {
+	d := testDevice(hostname, hostname)
+	if typ != "" {
+		d.DeviceType = &DeviceType{ID: typ, Name: typ}
+	}
+	return &Alert{Kind: AlertDown, Device: d, Time: t, State: StateDown, Message: hostname + " is down"}
+}
+
+func TestSMTPNotify(t *testing.T) {
+	s, tc := newSMTPServer(t, "user", "pass", 0)
+	defer s.l.Close()
+
+	routes := map[string]string{"router": "net@example.com; all@example.com", "switch": "sw@example.com", "*": "all@example.com"}
+	n, err := NewSMTPNotifier("127.0.0.1", s.port(), "user", "pass", "pinger@example.com", true, routes, []string{"router"}, 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unable to create SMTPNotifier: %v", err)
+	}
+	n.tls = tc
+
+	now := time.Now()
+
+	//critical device types are sent immediately to every matching recipient, once
+	if err = n.Notify(testAlert("router", "core", now)); err != nil {
+		t.Fatalf("Unable to notify: %v", err)
+	}
+	m := s.next(time.Second)
+	if m == nil {
+		t.Fatal("No message received")
+	}
+	if !m.tls || !m.auth {
+		t.Errorf("tls = %v, auth = %v, want both", m.tls, m.auth)
+	}
+	if got := strings.Join(m.rcpts, ","); got != "net@example.com,all@example.com" {
+		t.Errorf("recipients = %s, want net@example.com,all@example.com", got)
+	}
+	if got := m.subject(); got != "[net-monitor] core is down" {
+		t.Errorf("subject = %q", got)
+	}
+
+	//other device types are sent in a digest per recipient
+	n.Notify(testAlert("switch", "access1", now.Add(time.Second)))
+	n.Notify(testAlert("", "printer", now))
+	if m = s.next(100 * time.Millisecond); m != nil {
+		t.Fatalf("Digested Alert sent immediately to %v", m.rcpts)
+	}
+
+	digests := make(map[string]*smtpMessage)
+	for i := 0; i < 2; i++ {
+		if m = s.next(time.Second); m == nil {
+			t.Fatal("No digest received")
+		}
+		digests[strings.Join(m.rcpts, ",")] = m
+	}
+
+	tests := []struct {
+		rcpt    string
+		subject string
+		lines   []string
+	}{
+		{"sw@example.com", "[net-monitor] 1 alerts", []string{"access1 is down"}},
+		//oldest first
+		{"all@example.com", "[net-monitor] 2 alerts", []string{"printer is down", "access1 is down"}},
+	}
+	for _, test := range tests {
+		m := digests[test.rcpt]
+		if m == nil {
+			t.Errorf("No digest for %s", test.rcpt)
+			continue
+		}
+		if got := m.subject(); got != test.subject {
+			t.Errorf("%s: subject = %q, want %q", test.rcpt, got, test.subject)
+		}
+		last := -1
+		for _, l := range test.lines {
+			i := strings.Index(m.data, l)
+			if i <= last {
+				t.Errorf("%s: %q missing or out of order in:\n%s", test.rcpt, l, m.data)
+			}
+			last = i
+		}
+	}
+}
+
+func TestSMTPDigestRequeue(t *testing.T) {
+	s, _ := newSMTPServer(t, "", "", 1)
+	defer s.l.Close()
+
+	n, err := NewSMTPNotifier("127.0.0.1", s.port(), "", "", "pinger@example.com", false, map[string]string{"*": "all@example.com"}, nil, 300*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unable to create SMTPNotifier: %v", err)
+	}
+
+	now := time.Now()
+	n.Notify(testAlert("", "first", now))
+
+	//the first digest is rejected and kept for the next one, along with newer Alerts
+	time.Sleep(450 * time.Millisecond)
+	n.Notify(testAlert("", "second", now.Add(time.Second)))
+
+	m := s.next(time.Second)
+	if m == nil {
+		t.Fatal("No digest received")
+	}
+	if got := m.subject(); got != "[net-monitor] 2 alerts" {
+		t.Errorf("subject = %q, want 2 alerts", got)
+	}
+	if i, j := strings.Index(m.data, "first is down"), strings.Index(m.data, "second is down"); i < 0 || j < i {
+		t.Errorf("Alerts missing or out of order in:\n%s", m.data)
+	}
+}
+
+func TestSMTPDigestCap(t *testing.T) {
+	n, err := NewSMTPNotifier("127.0.0.1", 25, "", "", "pinger@example.com", false, map[string]string{"*": "all@example.com"}, nil, time.Hour)
+	if err != nil {
+		t.Fatalf("Unable to create SMTPNotifier: %v", err)
+	}
+
+	now := time.Now()
+	for i := 0; i < smtpMaxDigest+10; i++ {
+		n.Notify(testAlert("", fmt.Sprintf("host%d", i), now.Add(time.Duration(i)*time.Second)))
+	}
+
+	n.digestMu.Lock()
+	q := n.digest["all@example.com"]
+	n.digestMu.Unlock()
+
+	if len(q) != smtpMaxDigest {
+		t.Fatalf("digest length = %d, want %d", len(q), smtpMaxDigest)
+	}
+	//the oldest Alerts are dropped
+	if q[0].Device.Hostname != "host10" || !sort.SliceIsSorted(q, func(i, j int) bool { return q[i].Time.Before(q[j].Time) }) {
+		t.Errorf("digest starts with %s, want host10", q[0].Device.Hostname)
+	}
+}
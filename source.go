@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+//DeviceSource is a source of Devices to monitor
+type DeviceSource interface {
+	//SubscribeDevices calls f with every Device each time they change
+	SubscribeDevices(f func(devices []*Device)) error
+}
+
+//fileDevice is a Device in a device file
+type fileDevice struct {
+	ID             string   `json:"id" yaml:"id"`
+	Hostname       string   `json:"hostname" yaml:"hostname"`
+	IPs            []string `json:"ips" yaml:"ips"`
+	NoDNS          bool     `json:"no_dns" yaml:"no_dns"`
+	Subnet         *string  `json:"subnet" yaml:"subnet"`
+	Nameservers    []string `json:"nameservers" yaml:"nameservers"`
+	DeviceType     string   `json:"device_type" yaml:"device_type"`
+	ParentDeviceID *string  `json:"parent_device_id" yaml:"parent_device_id"`
+	PingInterval   *int     `json:"ping_interval" yaml:"ping_interval"` // in seconds
+	PingTimeout    *int     `json:"ping_timeout" yaml:"ping_timeout"`   // in milliseconds
+	PingCount      *int     `json:"ping_count" yaml:"ping_count"`
+	PingEnabled    *bool    `json:"ping_enabled" yaml:"ping_enabled"`
+}
+
+//parseCSVDevices parses a CSV device file. The first row is a header naming the columns, which are the fileDevice
+//fields. IPs are separated with semicolons
+func parseCSVDevices(r io.Reader) ([]*fileDevice, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse CSV: %v", err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("Missing header")
+	}
+
+	devices := make([]*fileDevice, 0, len(rows)-1)
+	for i, row := range rows[1:] {
+		d := new(fileDevice)
+		for j, col := range rows[0] {
+			v := strings.TrimSpace(row[j])
+			if v == "" {
+				continue
+			}
+
+			var err error
+			optInt := func() *int {
+				n, e := strconv.Atoi(v)
+				if e != nil {
+					err = e
+				}
+				return &n
+			}
+
+			switch strings.TrimSpace(col) {
+			case "id":
+				d.ID = v
+			case "hostname":
+				d.Hostname = v
+			case "ips":
+				for _, ip := range strings.Split(v, ";") {
+					d.IPs = append(d.IPs, strings.TrimSpace(ip))
+				}
+			case "no_dns":
+				d.NoDNS, err = strconv.ParseBool(v)
+			case "subnet":
+				d.Subnet = &v
+			case "nameservers":
+				for _, ns := range strings.Split(v, ";") {
+					d.Nameservers = append(d.Nameservers, strings.TrimSpace(ns))
+				}
+			case "device_type":
+				d.DeviceType = v
+			case "parent_device_id":
+				d.ParentDeviceID = &v
+			case "ping_interval":
+				d.PingInterval = optInt()
+			case "ping_timeout":
+				d.PingTimeout = optInt()
+			case "ping_count":
+				d.PingCount = optInt()
+			case "ping_enabled":
+				b, e := strconv.ParseBool(v)
+				d.PingEnabled, err = &b, e
+			default:
+				return nil, fmt.Errorf("Unknown column: %s", col)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s on row %d: %v", col, i+2, err)
+			}
+		}
+		devices = append(devices, d)
+	}
+
+	return devices, nil
+}
+
+//FileDeviceSource is a DeviceSource that reads Devices from a YAML, JSON, or CSV file, chosen by the file's extension.
+//The file is checked for changes periodically
+type FileDeviceSource struct {
+	path     string
+	interval time.Duration
+
+	modTime time.Time
+	size    int64
+}
+
+//NewFileDeviceSource returns a new FileDeviceSource for the file at path, checking it for changes every interval
+func NewFileDeviceSource(path string, interval time.Duration) (*FileDeviceSource, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json", ".csv":
+	default:
+		return nil, fmt.Errorf("Unknown file type: %s", path)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("Invalid interval: %v", interval)
+	}
+
+	return &FileDeviceSource{path: path, interval: interval}, nil
+}
+
+//load reads and parses the Devices in the file
+func (s *FileDeviceSource) load() ([]*Device, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to stat file: %v", err)
+	}
+	buf, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read file: %v", err)
+	}
+	s.modTime, s.size = info.ModTime(), info.Size()
+
+	var fds []*fileDevice
+	switch strings.ToLower(filepath.Ext(s.path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(buf, &fds)
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&fds)
+	case ".csv":
+		fds, err = parseCSVDevices(bytes.NewReader(buf))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse file: %v", err)
+	}
+
+	devices := make([]*Device, 0, len(fds))
+	types := make(map[string]*DeviceType)
+	ids := make(map[string]struct{})
+	for i, fd := range fds {
+		if fd.ID == "" {
+			return nil, fmt.Errorf("Device %d: missing id", i+1)
+		}
+		if _, ok := ids[fd.ID]; ok {
+			return nil, fmt.Errorf("Device %s: duplicate id", fd.ID)
+		}
+		ids[fd.ID] = struct{}{}
+		if fd.Hostname == "" && len(fd.IPs) == 0 && fd.Subnet == nil {
+			return nil, fmt.Errorf("Device %s: missing hostname, ips, or subnet", fd.ID)
+		}
+		switch {
+		case fd.PingInterval != nil && *fd.PingInterval < 1:
+			return nil, fmt.Errorf("Device %s: invalid ping_interval: %d", fd.ID, *fd.PingInterval)
+		case fd.PingTimeout != nil && *fd.PingTimeout < 1:
+			return nil, fmt.Errorf("Device %s: invalid ping_timeout: %d", fd.ID, *fd.PingTimeout)
+		case fd.PingCount != nil && *fd.PingCount < 1:
+			return nil, fmt.Errorf("Device %s: invalid ping_count: %d", fd.ID, *fd.PingCount)
+		}
+		if fd.NoDNS && len(fd.IPs) == 0 && parseIP(fd.Hostname) == nil {
+			return nil, fmt.Errorf("Device %s: no_dns requires ips or an IP address hostname", fd.ID)
+		}
+
+		d := &Device{
+			ID:       fd.ID,
+			Hostname: fd.Hostname,
+			DeviceSettings: DeviceSettings{
+				PingInterval: fd.PingInterval,
+				PingTimeout:  fd.PingTimeout,
+				PingCount:    fd.PingCount,
+				PingEnabled:  fd.PingEnabled,
+			},
+			ParentDeviceID: fd.ParentDeviceID,
+			NoDNS:          fd.NoDNS,
+			Subnet:         fd.Subnet,
+		}
+		if len(fd.Nameservers) > 0 {
+			ns := strings.Join(fd.Nameservers, ",")
+			if _, err := parseNameservers(ns); err != nil {
+				return nil, fmt.Errorf("Device %s: %v", fd.ID, err)
+			}
+			d.Nameservers = &ns
+		}
+		//Devices without a hostname are only known by IP or subnet
+		if d.Hostname == "" && d.Subnet != nil {
+			d.Hostname = *d.Subnet
+		} else if d.Hostname == "" {
+			d.Hostname = fd.IPs[0]
+			d.NoDNS = true
+		}
+
+		for _, s := range fd.IPs {
+			ip := parseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Device %s: invalid IP: %s", fd.ID, s)
+			}
+			d.StaticIPs = append(d.StaticIPs, ip)
+		}
+
+		//Devices with the same type name share a DeviceType
+		if fd.DeviceType != "" {
+			t, ok := types[fd.DeviceType]
+			if !ok {
+				t = &DeviceType{ID: fd.DeviceType, Name: fd.DeviceType}
+				types[fd.DeviceType] = t
+			}
+			d.DeviceType = t
+		}
+
+		devices = append(devices, d)
+	}
+
+	return devices, nil
+}
+
+//SubscribeDevices calls f with the Devices in the file, and again each time the file changes. If the file can't be
+//loaded, an error is returned. If a changed file can't be loaded, the error is logged and the previous Devices are kept
+func (s *FileDeviceSource) SubscribeDevices(f func(devices []*Device)) error {
+	devices, err := s.load()
+	if err != nil {
+		return err
+	}
+	f(devices)
+
+	go s.watcher(f)
+
+	return nil
+}
+
+func (s *FileDeviceSource) watcher(f func(devices []*Device)) {
+	for {
+		time.Sleep(s.interval)
+
+		info, err := os.Stat(s.path)
+		if err != nil {
+			log.Println("FileDeviceSource: Unable to stat file:", err)
+			continue
+		}
+		if info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+			continue
+		}
+
+		devices, err := s.load()
+		if err != nil {
+			log.Println("FileDeviceSource: Unable to reload Devices:", err)
+			continue
+		}
+		log.Println("FileDeviceSource: Reloaded", len(devices), "Devices from", s.path)
+		f(devices)
+	}
+}
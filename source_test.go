@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//deviceString formats d as id hostname [ips] no_dns type, for comparing loaded Devices
+func deviceString(d *Device) string {
+	ips := make([]string, 0, len(d.StaticIPs))
+	for _, ip := range d.StaticIPs {
+		ips = append(ips, ip.String())
+	}
+	s := fmt.Sprintf("%s %s %v %v", d.ID, d.Hostname, ips, d.NoDNS)
+	if d.DeviceType != nil {
+		s += " " + d.DeviceType.Name
+	}
+	return s
+}
+
+//loadDevices writes data to a device file with the given extension and loads it
+func loadDevices(t *testing.T, ext, data string) ([]*Device, error) {
+	t.Helper()
+	path := filepath.Join(tempDir(t), "devices"+ext)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("Unable to write device file: %v", err)
+	}
+	s, err := NewFileDeviceSource(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Unable to create FileDeviceSource: %v", err)
+	}
+	return s.load()
+}
+
+func TestNewFileDeviceSource(t *testing.T) {
+	tests := []struct {
+		path     string
+		interval time.Duration
+		err      bool
+	}{
+		{"devices.yaml", time.Second, false},
+		{"devices.YML", time.Second, false},
+		{"devices.json", time.Second, false},
+		{"devices.csv", time.Second, false},
+		{"devices.txt", time.Second, true},
+		{"devices", time.Second, true},
+		{"devices.yaml", 0, true},
+	}
+	for _, test := range tests {
+		if _, err := NewFileDeviceSource(test.path, test.interval); (err != nil) != test.err {
+			t.Errorf("%s, %v: err = %v, want error: %v", test.path, test.interval, err, test.err)
+		}
+	}
+}
+
+func TestFileDeviceSourceFormats(t *testing.T) {
+	want := []string{
+		"1 router.example.com [] false Router",
+		"2 192.0.2.2 [192.0.2.2] true",
+		"3 switch.example.com [192.0.2.3 2001:db8::3] true Router",
+	}
+
+	tests := []struct {
+		ext  string
+		data string
+	}{
+		{".yaml", `
+- id: "1"
+  hostname: router.example.com
+  device_type: Router
+- id: "2"
+  ips: [192.0.2.2]
+- id: "3"
+  hostname: switch.example.com
+  ips: [192.0.2.3, "2001:db8::3"]
+  no_dns: true
+  device_type: Router
+`},
+		{".json", `[
+	{"id": "1", "hostname": "router.example.com", "device_type": "Router"},
+	{"id": "2", "ips": ["192.0.2.2"]},
+	{"id": "3", "hostname": "switch.example.com", "ips": ["192.0.2.3", "2001:db8::3"], "no_dns": true, "device_type": "Router"}
+]`},
+		{".csv", `id,hostname,ips,no_dns,device_type
+1,router.example.com,,,Router
+2,,192.0.2.2,,
+3,switch.example.com,192.0.2.3; 2001:db8::3,true,Router
+`},
+	}
+
+	for _, test := range tests {
+		devices, err := loadDevices(t, test.ext, test.data)
+		if err != nil {
+			t.Errorf("%s: Unable to load Devices: %v", test.ext, err)
+			continue
+		}
+		got := make([]string, 0, len(devices))
+		for _, d := range devices {
+			got = append(got, deviceString(d))
+		}
+		if !stringSlicesEqual(got, want) {
+			t.Errorf("%s: Devices = %q, want %q", test.ext, got, want)
+		}
+		//Devices with the same type name share a DeviceType
+		if len(devices) == 3 && devices[0].DeviceType != devices[2].DeviceType {
+			t.Errorf("%s: DeviceTypes aren't shared", test.ext)
+		}
+	}
+}
+
+func TestFileDeviceSourceSettings(t *testing.T) {
+	devices, err := loadDevices(t, ".csv", `id,subnet,nameservers,parent_device_id,ping_interval,ping_timeout,ping_count,ping_enabled
+1,192.0.2.0/30,192.0.2.53;192.0.2.54,2,30,500,3,false
+`)
+	if err != nil {
+		t.Fatalf("Unable to load Devices: %v", err)
+	}
+	d := devices[0]
+	s := d.DeviceSettings
+	if d.Hostname != "192.0.2.0/30" || d.Subnet == nil || *d.Subnet != "192.0.2.0/30" {
+		t.Errorf("Hostname = %s, Subnet = %v, want the subnet", d.Hostname, d.Subnet)
+	}
+	if d.Nameservers == nil || *d.Nameservers != "192.0.2.53,192.0.2.54" {
+		t.Errorf("Nameservers = %v, want 192.0.2.53,192.0.2.54", d.Nameservers)
+	}
+	if d.ParentDeviceID == nil || *d.ParentDeviceID != "2" {
+		t.Errorf("ParentDeviceID = %v, want 2", d.ParentDeviceID)
+	}
+	if s.PingInterval == nil || *s.PingInterval != 30 || s.PingTimeout == nil || *s.PingTimeout != 500 ||
+		s.PingCount == nil || *s.PingCount != 3 || s.PingEnabled == nil || *s.PingEnabled {
+		t.Errorf("DeviceSettings = %+v, want 30, 500, 3, false", s)
+	}
+}
+
+func TestFileDeviceSourceInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		ext  string
+		data string
+		err  string
+	}{
+		{"missing id", ".yaml", `[{hostname: router}]`, "missing id"},
+		{"duplicate id", ".yaml", `[{id: "1", hostname: a}, {id: "1", hostname: b}]`, "duplicate id"},
+		{"duplicate id", ".csv", "id,hostname\n1,a\n1,b\n", "duplicate id"},
+		{"missing address", ".json", `[{"id": "1"}]`, "missing hostname, ips, or subnet"},
+		{"no_dns hostname", ".yaml", `[{id: "1", hostname: router, no_dns: true}]`, "no_dns requires"},
+		{"invalid ip", ".yaml", `[{id: "1", ips: [router]}]`, "invalid IP"},
+		{"invalid nameserver", ".yaml", `[{id: "1", hostname: router, nameservers: [ns]}]`, "Device 1"},
+		{"invalid ping_interval", ".yaml", `[{id: "1", hostname: router, ping_interval: 0}]`, "invalid ping_interval"},
+		{"invalid ping_timeout", ".json", `[{"id": "1", "hostname": "router", "ping_timeout": -1}]`, "invalid ping_timeout"},
+		{"invalid ping_count", ".csv", "id,hostname,ping_count\n1,router,0\n", "invalid ping_count"},
+		{"unknown field", ".yaml", `[{id: "1", hostname: router, address: 192.0.2.1}]`, "Unable to parse"},
+		{"unknown field", ".json", `[{"id": "1", "hostname": "router", "address": "192.0.2.1"}]`, "Unable to parse"},
+		{"unknown column", ".csv", "id,hostname,address\n1,router,192.0.2.1\n", "Unknown column"},
+		{"invalid value", ".csv", "id,hostname,ping_count\n1,router,three\n", "Invalid ping_count on row 2"},
+		{"missing field", ".csv", "id,hostname\n1\n", "Unable to parse"},
+		{"empty", ".csv", "", "Missing header"},
+	}
+
+	for _, test := range tests {
+		_, err := loadDevices(t, test.ext, test.data)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s%s: err = %v, want %q", test.name, test.ext, err, test.err)
+		}
+	}
+}
+
+func TestFileDeviceSourceReload(t *testing.T) {
+	path := filepath.Join(tempDir(t), "devices.yaml")
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatalf("Unable to write device file: %v", err)
+		}
+	}
+	write(`[{id: "1", hostname: a}]`)
+
+	s, err := NewFileDeviceSource(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unable to create FileDeviceSource: %v", err)
+	}
+	updates := make(chan []*Device, 10)
+	if err = s.SubscribeDevices(func(devices []*Device) { updates <- devices }); err != nil {
+		t.Fatalf("Unable to subscribe: %v", err)
+	}
+
+	next := func() []*Device {
+		select {
+		case devices := <-updates:
+			return devices
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for Devices")
+			return nil
+		}
+	}
+	if devices := next(); len(devices) != 1 {
+		t.Fatalf("initial Devices = %d, want 1", len(devices))
+	}
+
+	//an invalid file is logged and the previous Devices are kept
+	write(`[{id: "1", hostname: a}, {id: "1", hostname: b}]`)
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case devices := <-updates:
+		t.Errorf("invalid file was loaded with %d Devices", len(devices))
+	default:
+	}
+
+	write(`[{id: "1", hostname: a}, {id: "2", hostname: bb}]`)
+	if devices := next(); len(devices) != 2 {
+		t.Errorf("reloaded Devices = %d, want 2", len(devices))
+	}
+}
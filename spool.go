@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//spoolHeader is the length of a record header: the record length followed by its CRC-32
+const spoolHeader = 8
+
+//spoolMaxRecord is the largest record length accepted when reading, so a corrupt header can't cause a huge allocation
+const spoolMaxRecord = 1 << 28
+
+//spoolCheckpoint is the name of the file storing the replay position
+const spoolCheckpoint = "checkpoint"
+
+//segment is a spool file
+type segment struct {
+	id   uint64
+	size int64
+}
+
+//Spool is a durable queue of records on disk. Records are appended to segment files, each synced to disk before
+//Append returns. Records are replayed oldest first, and the position of the next record to replay is checkpointed so
+//replay resumes where it stopped after a restart. If the Spool grows past its maximum size, the oldest segments are
+//evicted
+type Spool struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64
+
+	//segments is ordered oldest first. The last segment is open for writing
+	segments []*segment
+	file     *os.File
+
+	//readSeg and readOff are the position of the next record to replay
+	readSeg uint64
+	readOff int64
+
+	evicted uint64
+
+	mu       *sync.Mutex
+	replayMu *sync.Mutex
+}
+
+func segmentName(id uint64) string {
+	return fmt.Sprintf("%020d.seg", id)
+}
+
+//OpenSpool opens or creates the Spool in dir. Records after the last complete record in each segment (e.g. from a
+//crash during a write) are truncated
+func OpenSpool(dir string, segmentSize, maxSize int64) (*Spool, error) {
+	if segmentSize <= 0 || maxSize < segmentSize {
+		return nil, fmt.Errorf("Invalid sizes: segment: %d, max: %d", segmentSize, maxSize)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create directory: %v", err)
+	}
+
+	s := &Spool{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSize:     maxSize,
+		segments:    make([]*segment, 0),
+		mu:          new(sync.Mutex),
+		replayMu:    new(sync.Mutex),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read directory: %v", err)
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".seg") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, &segment{id: id})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+
+	if err = s.readCheckpoint(); err != nil {
+		return nil, err
+	}
+
+	//remove segments that were fully replayed
+	segments := s.segments[:0]
+	for _, seg := range s.segments {
+		if seg.id < s.readSeg {
+			if err = os.Remove(filepath.Join(dir, segmentName(seg.id))); err != nil {
+				return nil, fmt.Errorf("Unable to remove segment: %v", err)
+			}
+			continue
+		}
+		segments = append(segments, seg)
+	}
+	s.segments = segments
+
+	for _, seg := range s.segments {
+		if seg.size, err = s.recover(seg.id); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(s.segments) == 0 {
+		next := s.readSeg
+		if next == 0 {
+			next = 1
+		}
+		s.segments = append(s.segments, &segment{id: next})
+	}
+	if s.readSeg < s.segments[0].id {
+		s.readSeg, s.readOff = s.segments[0].id, 0
+	}
+	//the checkpointed record may have been truncated
+	if s.readOff > s.segments[0].size {
+		s.readOff = s.segments[0].size
+	}
+
+	last := s.segments[len(s.segments)-1]
+	if s.file, err = os.OpenFile(filepath.Join(dir, segmentName(last.id)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return nil, fmt.Errorf("Unable to open segment: %v", err)
+	}
+
+	if size := s.Size(); size > 0 {
+		log.Printf("Spool: Recovered %d bytes in %d segments from %s\n", size, len(s.segments), dir)
+	}
+
+	return s, nil
+}
+
+//readCheckpoint reads the replay position. A missing checkpoint starts at the oldest segment
+func (s *Spool) readCheckpoint() error {
+	buf, err := ioutil.ReadFile(filepath.Join(s.dir, spoolCheckpoint))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read checkpoint: %v", err)
+	}
+	if _, err = fmt.Sscanf(string(buf), "%d %d", &s.readSeg, &s.readOff); err != nil {
+		log.Println("Spool: Invalid checkpoint, replaying from the oldest segment:", err)
+		s.readSeg, s.readOff = 0, 0
+	}
+	return nil
+}
+
+//writeCheckpoint atomically writes the replay position. s.mu must be held
+func (s *Spool) writeCheckpoint() error {
+	path := filepath.Join(s.dir, spoolCheckpoint)
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to create checkpoint: %v", err)
+	}
+	if _, err = fmt.Fprintf(f, "%d %d\n", s.readSeg, s.readOff); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write checkpoint: %v", err)
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("Unable to replace checkpoint: %v", err)
+	}
+	return nil
+}
+
+//recover validates every record in the segment with the given id, truncates anything after the last valid record,
+//and returns the segment's size
+func (s *Spool) recover(id uint64) (int64, error) {
+	path := filepath.Join(s.dir, segmentName(id))
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to open segment: %v", err)
+	}
+	defer f.Close()
+
+	var off int64
+	for {
+		_, n, err := readRecord(f, off)
+		if err == io.EOF {
+			return off, nil
+		}
+		if err != nil {
+			log.Printf("Spool: Truncating segment %s at %d: %v\n", segmentName(id), off, err)
+			if err = os.Truncate(path, off); err != nil {
+				return 0, fmt.Errorf("Unable to truncate segment: %v", err)
+			}
+			return off, nil
+		}
+		off += n
+	}
+}
+
+//readRecord reads the record at off and returns it and its length on disk. io.EOF is returned if there are no more
+//records
+func readRecord(r io.ReaderAt, off int64) ([]byte, int64, error) {
+	header := make([]byte, spoolHeader)
+	n, err := r.ReadAt(header, off)
+	if n == 0 && err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if n < spoolHeader {
+		return nil, 0, fmt.Errorf("Incomplete header")
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length > spoolMaxRecord {
+		return nil, 0, fmt.Errorf("Invalid record length: %d", length)
+	}
+	data := make([]byte, length)
+	if n, _ = r.ReadAt(data, off+spoolHeader); n < int(length) {
+		return nil, 0, fmt.Errorf("Incomplete record")
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, fmt.Errorf("Invalid checksum")
+	}
+
+	return data, spoolHeader + int64(length), nil
+}
+
+//Append durably appends data to the Spool
+func (s *Spool) Append(data []byte) error {
+	buf := make([]byte, spoolHeader+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(data))
+	copy(buf[spoolHeader:], data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last := s.segments[len(s.segments)-1]
+	if last.size > 0 && last.size+int64(len(buf)) > s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		last = s.segments[len(s.segments)-1]
+	}
+
+	if _, err := s.file.Write(buf); err != nil {
+		//drop the partial write so the segment stays readable
+		s.file.Truncate(last.size)
+		return fmt.Errorf("Unable to write record: %v", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("Unable to sync segment: %v", err)
+	}
+	last.size += int64(len(buf))
+
+	s.evict()
+	return nil
+}
+
+//rotate closes the current segment and starts a new one. s.mu must be held
+func (s *Spool) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("Unable to close segment: %v", err)
+	}
+
+	seg := &segment{id: s.segments[len(s.segments)-1].id + 1}
+	f, err := os.OpenFile(filepath.Join(s.dir, segmentName(seg.id)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to create segment: %v", err)
+	}
+
+	s.file = f
+	s.segments = append(s.segments, seg)
+	return nil
+}
+
+//evict removes the oldest segments until the Spool is under its maximum size. The segment being written is never
+//evicted. s.mu must be held
+func (s *Spool) evict() {
+	for s.size() > s.maxSize && len(s.segments) > 1 {
+		seg := s.segments[0]
+		if err := os.Remove(filepath.Join(s.dir, segmentName(seg.id))); err != nil {
+			log.Printf("Spool: Unable to evict segment %s: %v\n", segmentName(seg.id), err)
+			return
+		}
+		s.segments = s.segments[1:]
+
+		evicted := seg.size
+		if s.readSeg == seg.id {
+			evicted -= s.readOff
+		}
+		s.evicted += uint64(evicted)
+		log.Printf("Spool: Maximum size reached, evicted %d bytes\n", evicted)
+
+		if s.readSeg <= seg.id {
+			s.readSeg, s.readOff = s.segments[0].id, 0
+			if err := s.writeCheckpoint(); err != nil {
+				log.Println("Spool:", err)
+			}
+		}
+	}
+}
+
+//size returns the number of bytes waiting to be replayed. s.mu must be held
+func (s *Spool) size() int64 {
+	var size int64
+	for _, seg := range s.segments {
+		if seg.id >= s.readSeg {
+			size += seg.size
+		}
+		if seg.id == s.readSeg {
+			size -= s.readOff
+		}
+	}
+	return size
+}
+
+//Size returns the number of bytes waiting to be replayed
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size()
+}
+
+//Evicted returns the number of bytes evicted before they were replayed
+func (s *Spool) Evicted() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.evicted
+}
+
+//next returns the next record to replay and the position after it, or nil if there are no more records.
+//Fully replayed segments are removed
+func (s *Spool) next() ([]byte, uint64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		seg := s.segments[0]
+		if s.readOff < seg.size {
+			f, err := os.Open(filepath.Join(s.dir, segmentName(seg.id)))
+			if err != nil {
+				return nil, 0, 0, fmt.Errorf("Unable to open segment: %v", err)
+			}
+			data, n, err := readRecord(f, s.readOff)
+			f.Close()
+			if err != nil {
+				return nil, 0, 0, fmt.Errorf("Unable to read record: %v", err)
+			}
+			return data, seg.id, s.readOff + n, nil
+		}
+
+		if len(s.segments) == 1 {
+			return nil, 0, 0, nil
+		}
+
+		if err := os.Remove(filepath.Join(s.dir, segmentName(seg.id))); err != nil {
+			return nil, 0, 0, fmt.Errorf("Unable to remove segment: %v", err)
+		}
+		s.segments = s.segments[1:]
+		s.readSeg, s.readOff = s.segments[0].id, 0
+		if err := s.writeCheckpoint(); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+}
+
+//Replay calls f with each record in order, oldest first, until f returns an error or there are no more records.
+//Records are only removed after f succeeds. The number of records replayed is returned
+func (s *Spool) Replay(f func(data []byte) error) (int, error) {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+
+	count := 0
+	for {
+		data, seg, off, err := s.next()
+		if err != nil || data == nil {
+			return count, err
+		}
+
+		if err = f(data); err != nil {
+			return count, err
+		}
+		count++
+
+		s.mu.Lock()
+		//the record's segment may have been evicted while f was running
+		if s.readSeg == seg {
+			s.readOff = off
+			err = s.writeCheckpoint()
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return count, err
+		}
+	}
+}
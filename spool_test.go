@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//tempDir returns a temporary directory that's removed when the test finishes
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+//openSpool opens the Spool in dir or fails the test
+func openSpool(t *testing.T, dir string, segmentSize, maxSize int64) *Spool {
+	t.Helper()
+	s, err := OpenSpool(dir, segmentSize, maxSize)
+	if err != nil {
+		t.Fatalf("Unable to open Spool: %v", err)
+	}
+	return s
+}
+
+//appendRecords appends each record to s or fails the test
+func appendRecords(t *testing.T, s *Spool, records ...string) {
+	t.Helper()
+	for _, r := range records {
+		if err := s.Append([]byte(r)); err != nil {
+			t.Fatalf("Unable to append %q: %v", r, err)
+		}
+	}
+}
+
+//replayAll replays every record in s and returns them joined with spaces
+func replayAll(t *testing.T, s *Spool) string {
+	t.Helper()
+	records := make([]string, 0)
+	if _, err := s.Replay(func(data []byte) error {
+		records = append(records, string(data))
+		return nil
+	}); err != nil {
+		t.Fatalf("Unable to replay: %v", err)
+	}
+	return strings.Join(records, " ")
+}
+
+func TestOpenSpoolSizes(t *testing.T) {
+	tests := []struct {
+		segmentSize int64
+		maxSize     int64
+		err         bool
+	}{
+		{0, 100, true},
+		{-1, 100, true},
+		{100, 99, true},
+		{100, 100, false},
+		{100, 1000, false},
+	}
+	for _, test := range tests {
+		if _, err := OpenSpool(tempDir(t), test.segmentSize, test.maxSize); (err != nil) != test.err {
+			t.Errorf("%d, %d: err = %v, want error: %v", test.segmentSize, test.maxSize, err, test.err)
+		}
+	}
+}
+
+func TestSpoolRecovery(t *testing.T) {
+	//header returns a record header for data with the given checksum
+	header := func(length int, crc uint32) []byte {
+		h := make([]byte, spoolHeader)
+		binary.BigEndian.PutUint32(h, uint32(length))
+		binary.BigEndian.PutUint32(h[4:], crc)
+		return h
+	}
+
+	tests := []struct {
+		name    string
+		corrupt func(f *os.File, size int64)
+		want    string
+	}{
+		{"clean", func(f *os.File, size int64) {}, "a bb ccc"},
+		{"partial header", func(f *os.File, size int64) {
+			f.WriteAt([]byte{0, 0, 0}, size)
+		}, "a bb ccc"},
+		{"partial record", func(f *os.File, size int64) {
+			f.WriteAt(append(header(10, 0), "dddd"...), size)
+		}, "a bb ccc"},
+		{"invalid checksum", func(f *os.File, size int64) {
+			f.WriteAt(append(header(4, 0), "dddd"...), size)
+		}, "a bb ccc"},
+		{"invalid length", func(f *os.File, size int64) {
+			f.WriteAt(append(header(spoolMaxRecord+1, 0), "dddd"...), size)
+		}, "a bb ccc"},
+		//everything after a corrupt record is lost
+		{"corrupt record", func(f *os.File, size int64) {
+			f.WriteAt([]byte("x"), spoolHeader+1+spoolHeader)
+		}, "a"},
+	}
+
+	for _, test := range tests {
+		dir := tempDir(t)
+		s := openSpool(t, dir, 1024, 4096)
+		appendRecords(t, s, "a", "bb", "ccc")
+		size := s.Size()
+		s.file.Close()
+
+		path := filepath.Join(dir, segmentName(1))
+		f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+		if err != nil {
+			t.Fatalf("%s: Unable to open segment: %v", test.name, err)
+		}
+		test.corrupt(f, size)
+		f.Close()
+
+		s = openSpool(t, dir, 1024, 4096)
+		//new records are appended after the last valid record
+		appendRecords(t, s, "eeeee")
+		if got, want := replayAll(t, s), test.want+" eeeee"; got != want {
+			t.Errorf("%s: records = %q, want %q", test.name, got, want)
+		}
+		s.file.Close()
+	}
+}
+
+func TestSpoolCheckpoint(t *testing.T) {
+	tests := []struct {
+		name       string
+		checkpoint string
+		want       string
+	}{
+		{"resume", "", "bb ccc"},
+		{"invalid checkpoint", "invalid", "a bb ccc"},
+		{"missing checkpoint", "-", "a bb ccc"},
+		//the checkpointed record was truncated
+		{"past end of segment", fmt.Sprintf("1 %d", 1000), ""},
+	}
+
+	for _, test := range tests {
+		dir := tempDir(t)
+		s := openSpool(t, dir, 1024, 4096)
+		appendRecords(t, s, "a", "bb", "ccc")
+
+		//the replay stops at the first error, and resumes there after a restart
+		count, err := s.Replay(func(data []byte) error {
+			if string(data) == "bb" {
+				return fmt.Errorf("failed")
+			}
+			return nil
+		})
+		if count != 1 || err == nil {
+			t.Errorf("%s: replayed %d records, err = %v, want 1 and an error", test.name, count, err)
+		}
+		s.file.Close()
+
+		path := filepath.Join(dir, spoolCheckpoint)
+		switch test.checkpoint {
+		case "":
+		case "-":
+			os.Remove(path)
+		default:
+			ioutil.WriteFile(path, []byte(test.checkpoint), 0600)
+		}
+
+		s = openSpool(t, dir, 1024, 4096)
+		if got := replayAll(t, s); got != test.want {
+			t.Errorf("%s: records = %q, want %q", test.name, got, test.want)
+		}
+		s.file.Close()
+
+		//nothing is replayed twice
+		s = openSpool(t, dir, 1024, 4096)
+		if got := replayAll(t, s); got != "" {
+			t.Errorf("%s: records after replay = %q, want none", test.name, got)
+		}
+		s.file.Close()
+	}
+}
+
+func TestSpoolSegments(t *testing.T) {
+	dir := tempDir(t)
+	//each 7 byte record takes 15 bytes, so each record is in its own segment
+	s := openSpool(t, dir, 20, 1000)
+	appendRecords(t, s, "record1", "record2", "record3")
+
+	segments := func() int {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+		return len(files)
+	}
+	if n := segments(); n != 3 {
+		t.Errorf("segments = %d, want 3", n)
+	}
+
+	if got := replayAll(t, s); got != "record1 record2 record3" {
+		t.Errorf("records = %q", got)
+	}
+	//fully replayed segments are removed
+	if n := segments(); n != 1 {
+		t.Errorf("segments after replay = %d, want 1", n)
+	}
+	if size := s.Size(); size != 0 {
+		t.Errorf("size after replay = %d, want 0", size)
+	}
+
+	appendRecords(t, s, "record4")
+	s.file.Close()
+	s = openSpool(t, dir, 20, 1000)
+	if got := replayAll(t, s); got != "record4" {
+		t.Errorf("records after restart = %q, want record4", got)
+	}
+	s.file.Close()
+}
+
+func TestSpoolEviction(t *testing.T) {
+	tests := []struct {
+		name     string
+		replayed int
+		want     string
+		evicted  uint64
+	}{
+		{"none replayed", 0, "record4 record5", 45},
+		//evicted bytes only count records that weren't replayed
+		{"partially replayed", 1, "record4 record5", 30},
+	}
+
+	for _, test := range tests {
+		dir := tempDir(t)
+		//each record is in its own 15 byte segment, and only two segments fit
+		s := openSpool(t, dir, 20, 40)
+		appendRecords(t, s, "record1", "record2")
+
+		replayed := 0
+		s.Replay(func(data []byte) error {
+			if replayed == test.replayed {
+				return fmt.Errorf("stop")
+			}
+			replayed++
+			return nil
+		})
+
+		appendRecords(t, s, "record3", "record4", "record5")
+		if got := replayAll(t, s); got != test.want {
+			t.Errorf("%s: records = %q, want %q", test.name, got, test.want)
+		}
+		if evicted := s.Evicted(); evicted != test.evicted {
+			t.Errorf("%s: evicted = %d, want %d", test.name, evicted, test.evicted)
+		}
+		s.file.Close()
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+//State is the reachability state of a Device or IP
+type State string
+
+//Reachability states
+const (
+	StateUnknown  State = "unknown"
+	StateUp       State = "up"
+	StateDegraded State = "degraded"
+	StateDown     State = "down"
+	//StateUnreachable is a Device that's down because its parent Device is down
+	StateUnreachable State = "unreachable"
+)
+
+//Event is a reachability state transition for a Device, or one of its IPs if IP is not nil. Planned is true if the
+//transition happened during a MaintenanceWindow
+type Event struct {
+	*Device
+	IP            net.IP
+	Time          time.Time
+	PreviousState State
+	State         State
+	Flapping      bool
+	Planned       bool
+}
+
+//StateThresholds configures when state transitions happen
+type StateThresholds struct {
+	//Fail is the number of consecutive failed (or impaired) Pings before an IP is Down (or Degraded)
+	Fail int
+	//Recover is the number of consecutive good Pings before an IP is Up
+	Recover int
+	//DegradedLoss is the loss percentage at or above which a Ping is impaired
+	DegradedLoss float64
+	//DegradedRTT is the average RTT above which a Ping is impaired. If zero, RTT is ignored
+	DegradedRTT time.Duration
+	//FlapWindow and FlapCount configure flap damping: if FlapCount transitions happen within FlapWindow,
+	//events are suppressed until the state is stable for FlapWindow
+	FlapWindow time.Duration
+	FlapCount  int
+}
+
+//damper tracks transitions of a single state to detect flapping
+type damper struct {
+	state       State
+	emitted     State
+	transitions []time.Time
+	flapping    bool
+}
+
+//transition moves the damper to state at t and returns an Event template if one should be emitted
+func (d *damper) transition(state State, t time.Time, th *StateThresholds) *Event {
+	cutoff := t.Add(-th.FlapWindow)
+	recent := d.transitions[:0]
+	for _, tr := range d.transitions {
+		if tr.After(cutoff) {
+			recent = append(recent, tr)
+		}
+	}
+	d.transitions = recent
+
+	if state != d.state {
+		d.transitions = append(d.transitions, t)
+		d.state = state
+	}
+
+	if !d.flapping && th.FlapCount > 0 && len(d.transitions) >= th.FlapCount {
+		d.flapping = true
+		e := &Event{Time: t, PreviousState: d.emitted, State: d.state, Flapping: true}
+		d.emitted = d.state
+		return e
+	}
+
+	if d.flapping {
+		if len(d.transitions) > 0 {
+			return nil
+		}
+		d.flapping = false
+		e := &Event{Time: t, PreviousState: d.emitted, State: d.state}
+		d.emitted = d.state
+		return e
+	}
+
+	if d.state == d.emitted {
+		return nil
+	}
+
+	e := &Event{Time: t, PreviousState: d.emitted, State: d.state}
+	d.emitted = d.state
+	return e
+}
+
+//ipState is the state machine for a single IP
+type ipState struct {
+	damper
+	good   int
+	bad    int
+	failed int
+}
+
+//update moves the state machine forward with the result of p and returns the new state
+func (s *ipState) update(p *Ping, th *StateThresholds) State {
+	switch {
+	case p.Received == 0:
+		s.good = 0
+		s.bad++
+		s.failed++
+	case (p.Loss > 0 && p.Loss >= th.DegradedLoss) || (th.DegradedRTT > 0 && p.AvgRTT > th.DegradedRTT):
+		s.good = 0
+		s.bad++
+		s.failed = 0
+	default:
+		s.good++
+		s.bad = 0
+		s.failed = 0
+	}
+
+	switch {
+	case s.failed >= th.Fail:
+		return StateDown
+	case s.bad >= th.Fail:
+		return StateDegraded
+	case s.good >= th.Recover:
+		return StateUp
+	}
+	return s.state
+}
+
+//deviceState tracks a Device's aggregate state and the state of each of its IPs
+type deviceState struct {
+	damper
+	ips map[string]*ipState
+}
+
+//failing returns true if any of the Device's IPs have failed since their last reply
+func (s *deviceState) failing() bool {
+	for _, ip := range s.ips {
+		if ip.failed > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+//aggregate returns the Device's state from the state of its IPs: Up or Down if all IPs are, Unknown if any IP
+//is Unknown, and Degraded otherwise
+func (s *deviceState) aggregate() State {
+	counts := make(map[State]int)
+	for _, ip := range s.ips {
+		counts[ip.state]++
+	}
+	switch {
+	case len(s.ips) == 0 || counts[StateUnknown] > 0:
+		return StateUnknown
+	case counts[StateUp] == len(s.ips):
+		return StateUp
+	case counts[StateDown] == len(s.ips):
+		return StateDown
+	}
+	return StateDegraded
+}
+
+//StateTracker is a reachability state machine for every Device and IP
+type StateTracker struct {
+	thresholds *StateThresholds
+	devices    map[string]*deviceState
+	mu         *sync.Mutex
+}
+
+//NewStateTracker returns a new StateTracker with the given thresholds
+func NewStateTracker(thresholds *StateThresholds) *StateTracker {
+	return &StateTracker{
+		thresholds: thresholds,
+		devices:    make(map[string]*deviceState),
+		mu:         new(sync.Mutex),
+	}
+}
+
+//Update moves the state machines for p's Device and IP forward and returns any resulting Events
+func (t *StateTracker) Update(p *Ping) []*Event {
+	p.Device.mu.RLock()
+	current := make(map[string]struct{}, len(p.Device.ips))
+	for _, ip := range p.Device.ips {
+		current[ip.String()] = struct{}{}
+	}
+	var parentID string
+	if p.Device.ParentDeviceID != nil {
+		parentID = *p.Device.ParentDeviceID
+	}
+	p.Device.mu.RUnlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	d, ok := t.devices[p.Device.ID]
+	if !ok {
+		d = &deviceState{damper: damper{state: StateUnknown, emitted: StateUnknown}, ips: make(map[string]*ipState)}
+		t.devices[p.Device.ID] = d
+	}
+
+	//forget IPs the Device no longer resolves to
+	for ip := range d.ips {
+		if _, ok := current[ip]; !ok {
+			delete(d.ips, ip)
+		}
+	}
+
+	key := p.IP.String()
+	ip, ok := d.ips[key]
+	if !ok {
+		ip = &ipState{damper: damper{state: StateUnknown, emitted: StateUnknown}}
+		d.ips[key] = ip
+	}
+
+	now := time.Now()
+	events := make([]*Event, 0)
+	if e := ip.transition(ip.update(p, t.thresholds), now, t.thresholds); e != nil {
+		e.Device, e.IP = p.Device, p.IP
+		events = append(events, e)
+	}
+	state := d.aggregate()
+
+	//a Device behind a down parent is unreachable, not down. If the parent is failing but not down yet,
+	//hold the current state so the Device isn't reported down before its parent
+	if parent, ok := t.devices[parentID]; ok && state == StateDown {
+		switch {
+		case parent.state == StateDown || parent.state == StateUnreachable:
+			state = StateUnreachable
+		case parent.failing():
+			state = d.state
+		}
+	}
+
+	if e := d.transition(state, now, t.thresholds); e != nil {
+		e.Device = p.Device
+		events = append(events, e)
+	}
+
+	return events
+}
+
+//Remove forgets the state of the Device with the given id
+func (t *StateTracker) Remove(id string) {
+	t.mu.Lock()
+	delete(t.devices, id)
+	t.mu.Unlock()
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+//eventString formats e as previous->state, with a flapping suffix, or an empty string if e is nil
+func eventString(e *Event) string {
+	if e == nil {
+		return ""
+	}
+	s := fmt.Sprintf("%s->%s", e.PreviousState, e.State)
+	if e.Flapping {
+		s += " flapping"
+	}
+	return s
+}
+
+func TestDamperTransition(t *testing.T) {
+	type step struct {
+		state State
+		sec   int
+		want  string
+	}
+	tests := []struct {
+		name  string
+		count int
+		steps []step
+	}{
+		{"no damping", 0, []step{
+			{StateUp, 0, "unknown->up"},
+			{StateUp, 1, ""},
+			{StateDown, 2, "up->down"},
+			{StateUp, 3, "down->up"},
+			{StateDown, 4, "up->down"},
+			{StateUp, 5, "down->up"},
+		}},
+		{"below flap count", 3, []step{
+			{StateUp, 0, "unknown->up"},
+			{StateDown, 1, "up->down"},
+			{StateDown, 20, ""},
+			{StateUp, 21, "down->up"},
+		}},
+		{"flapping", 3, []step{
+			{StateUp, 0, "unknown->up"},
+			{StateDown, 1, "up->down"},
+			{StateUp, 2, "down->up flapping"},
+			//suppressed while transitions are in the window
+			{StateDown, 3, ""},
+			{StateDown, 4, ""},
+			{StateDown, 12, ""},
+			//stable for the window
+			{StateDown, 13, "up->down"},
+			{StateDown, 14, ""},
+			{StateUp, 15, "down->up"},
+		}},
+		{"flapping ends in emitted state", 3, []step{
+			{StateUp, 0, "unknown->up"},
+			{StateDown, 1, "up->down"},
+			{StateUp, 2, "down->up flapping"},
+			{StateDown, 3, ""},
+			{StateUp, 4, ""},
+			//the end of flapping is recorded even though the state didn't change
+			{StateUp, 14, "up->up"},
+		}},
+	}
+
+	start := time.Unix(1600000000, 0)
+	for _, test := range tests {
+		th := &StateThresholds{FlapWindow: 10 * time.Second, FlapCount: test.count}
+		d := &damper{state: StateUnknown, emitted: StateUnknown}
+		for i, s := range test.steps {
+			if got := eventString(d.transition(s.state, start.Add(time.Duration(s.sec)*time.Second), th)); got != s.want {
+				t.Errorf("%s: step %d (%s at %ds): event = %q, want %q", test.name, i, s.state, s.sec, got, s.want)
+			}
+		}
+	}
+}
+
+//testPing returns a Ping of d's first IP with every probe received or lost
+func testPing(d *Device, received bool) *Ping {
+	p := &Ping{Device: d, IP: d.ips[0], SentTime: time.Now(), Sent: 4, Received: 4, AvgRTT: time.Millisecond}
+	if !received {
+		p.Received, p.Loss, p.AvgRTT = 0, 100, 0
+	}
+	return p
+}
+
+func TestIPStateUpdate(t *testing.T) {
+	th := &StateThresholds{Fail: 2, Recover: 2, DegradedLoss: 50, DegradedRTT: 100 * time.Millisecond}
+	d := testDevice("1", "router")
+	d.ips = []net.IP{net.ParseIP("192.0.2.1")}
+
+	good := testPing(d, true)
+	lost := testPing(d, false)
+	lossy := &Ping{Device: d, IP: d.ips[0], Sent: 4, Received: 2, Loss: 50, AvgRTT: time.Millisecond}
+	slow := &Ping{Device: d, IP: d.ips[0], Sent: 4, Received: 4, AvgRTT: 200 * time.Millisecond}
+	minor := &Ping{Device: d, IP: d.ips[0], Sent: 4, Received: 3, Loss: 25, AvgRTT: time.Millisecond}
+
+	tests := []struct {
+		name  string
+		pings []*Ping
+		want  []State
+	}{
+		{"recover", []*Ping{good, good, good}, []State{StateUnknown, StateUp, StateUp}},
+		{"fail", []*Ping{good, good, lost, lost}, []State{StateUnknown, StateUp, StateUp, StateDown}},
+		{"fail reset by reply", []*Ping{good, good, lost, good, lost}, []State{StateUnknown, StateUp, StateUp, StateUp, StateUp}},
+		{"degraded by loss", []*Ping{good, good, lossy, lossy}, []State{StateUnknown, StateUp, StateUp, StateDegraded}},
+		{"degraded by rtt", []*Ping{good, good, slow, slow}, []State{StateUnknown, StateUp, StateUp, StateDegraded}},
+		{"loss below threshold", []*Ping{good, good, minor, minor}, []State{StateUnknown, StateUp, StateUp, StateUp}},
+		{"impaired then lost", []*Ping{good, good, slow, lost}, []State{StateUnknown, StateUp, StateUp, StateDegraded}},
+		{"down recovers", []*Ping{lost, lost, good, good}, []State{StateUnknown, StateDown, StateDown, StateUp}},
+	}
+
+	for _, test := range tests {
+		s := &ipState{damper: damper{state: StateUnknown, emitted: StateUnknown}}
+		for i, p := range test.pings {
+			state := s.update(p, th)
+			s.state = state
+			if state != test.want[i] {
+				t.Errorf("%s: Ping %d: state = %s, want %s", test.name, i, state, test.want[i])
+			}
+		}
+	}
+}
+
+func TestStateTrackerParent(t *testing.T) {
+	type step struct {
+		device   string
+		received bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		want  State
+	}{
+		{"parent up", []step{{"p", true}, {"c", true}, {"c", false}, {"c", false}}, StateDown},
+		{"no parent state", []step{{"c", true}, {"c", false}, {"c", false}}, StateDown},
+		{"parent down", []step{{"p", true}, {"c", true}, {"p", false}, {"p", false}, {"c", false}, {"c", false}}, StateUnreachable},
+		//the child is held up until the parent is down
+		{"parent failing", []step{{"p", true}, {"c", true}, {"p", false}, {"c", false}, {"c", false}}, StateUp},
+		{"parent failing then down", []step{{"p", true}, {"c", true}, {"p", false}, {"c", false}, {"c", false}, {"p", false}, {"c", false}}, StateUnreachable},
+		{"parent recovered", []step{{"p", true}, {"c", true}, {"p", false}, {"p", false}, {"c", false}, {"c", false}, {"p", true}, {"c", false}}, StateDown},
+		{"grandparent down", []step{{"g", true}, {"p", true}, {"c", true}, {"g", false}, {"g", false}, {"p", false}, {"p", false}, {"c", false}, {"c", false}}, StateUnreachable},
+	}
+
+	for _, test := range tests {
+		tr := NewStateTracker(&StateThresholds{Fail: 2, Recover: 1})
+
+		devices := make(map[string]*Device)
+		for i, id := range []string{"g", "p", "c"} {
+			d := testDevice(id, id)
+			d.ips = []net.IP{net.IPv4(192, 0, 2, byte(i+1))}
+			devices[id] = d
+		}
+		devices["p"].ParentDeviceID = stringPtr("g")
+		devices["c"].ParentDeviceID = stringPtr("p")
+
+		for _, s := range test.steps {
+			tr.Update(testPing(devices[s.device], s.received))
+		}
+
+		if got := tr.devices["c"].state; got != test.want {
+			t.Errorf("%s: state = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestStateTrackerRemovedIP(t *testing.T) {
+	tr := NewStateTracker(&StateThresholds{Fail: 1, Recover: 1})
+	d := testDevice("1", "router")
+	d.ips = []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}
+
+	tr.Update(testPing(d, true))
+	down := testPing(d, false)
+	down.IP = d.ips[1]
+	tr.Update(down)
+	if got := tr.devices["1"].state; got != StateDegraded {
+		t.Fatalf("state with a down IP = %s, want %s", got, StateDegraded)
+	}
+
+	//the Device's state is aggregated from the IPs it currently resolves to
+	d.ips = d.ips[:1]
+	events := tr.Update(testPing(d, true))
+	if got := tr.devices["1"].state; got != StateUp {
+		t.Errorf("state = %s, want %s", got, StateUp)
+	}
+	if len(events) != 1 || events[0].IP != nil || eventString(events[0]) != "degraded->up" {
+		t.Errorf("events = %v, want a Device degraded->up Event", events)
+	}
+}
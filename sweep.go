@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+//expandSubnet returns every host address in cidr, excluding the network and broadcast addresses of IPv4 subnets
+//larger than a /31. An error is returned if there are more than max addresses
+func expandSubnet(cidr string, max int) ([]net.IP, error) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse subnet: %v", err)
+	}
+
+	ones, bits := n.Mask.Size()
+	hostBits := bits - ones
+	if hostBits > 30 || 1<<uint(hostBits) > max+2 {
+		return nil, fmt.Errorf("Subnet %s has more than %d addresses", cidr, max)
+	}
+
+	ips := make([]net.IP, 0, 1<<uint(hostBits))
+	for ip := n.IP; n.Contains(ip); {
+		ips = append(ips, ip)
+
+		next := make(net.IP, len(ip))
+		copy(next, ip)
+		for i := len(next) - 1; i >= 0; i-- {
+			next[i]++
+			if next[i] != 0 {
+				break
+			}
+		}
+		ip = next
+	}
+
+	if bits == 32 && hostBits > 1 {
+		ips = ips[1 : len(ips)-1]
+	}
+	if len(ips) > max {
+		return nil, fmt.Errorf("Subnet %s has more than %d addresses", cidr, max)
+	}
+
+	return ips, nil
+}
+
+//HostChange is a host in a subnet sweep appearing or disappearing
+type HostChange struct {
+	IP   net.IP
+	Live bool
+	Time time.Time
+	//Alert is false for the first observation of a host, which only records its initial state
+	Alert bool
+}
+
+//SweepResult is the host changes of a subnet sweep Device
+type SweepResult struct {
+	Device  *Device
+	Changes []*HostChange
+}
+
+//sweepHost is the state of a single address in a subnet sweep
+type sweepHost struct {
+	live   bool
+	misses int
+}
+
+type sweepState struct {
+	device  *Device
+	hosts   map[[16]byte]*sweepHost
+	changes []*HostChange
+}
+
+//SweepTracker tracks the live hosts of subnet sweep Devices. A host appears when it replies, and disappears after
+//a number of consecutive Pings without a reply
+type SweepTracker struct {
+	fail   int
+	sweeps map[string]*sweepState
+	mu     *sync.Mutex
+}
+
+//NewSweepTracker returns a new SweepTracker where hosts disappear after fail consecutive Pings without a reply
+func NewSweepTracker(fail int) *SweepTracker {
+	return &SweepTracker{fail: fail, sweeps: make(map[string]*sweepState), mu: new(sync.Mutex)}
+}
+
+//Update records the result of p
+func (t *SweepTracker) Update(p *Ping) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.sweeps[p.Device.ID]
+	if !ok {
+		s = &sweepState{hosts: make(map[[16]byte]*sweepHost)}
+		t.sweeps[p.Device.ID] = s
+	}
+	s.device = p.Device
+
+	var k [16]byte
+	copy(k[:], p.IP.To16())
+	live := p.Received > 0
+
+	h, ok := s.hosts[k]
+	if !ok {
+		//record the initial state so stale hosts from a previous run are marked as not live
+		s.hosts[k] = &sweepHost{live: live}
+		s.changes = append(s.changes, &HostChange{IP: p.IP, Live: live, Time: p.SentTime})
+		return
+	}
+
+	if live {
+		h.misses = 0
+		if !h.live {
+			h.live = true
+			s.changes = append(s.changes, &HostChange{IP: p.IP, Live: true, Time: p.SentTime, Alert: true})
+		}
+		return
+	}
+
+	if !h.live {
+		return
+	}
+	h.misses++
+	if h.misses >= t.fail {
+		h.live = false
+		s.changes = append(s.changes, &HostChange{IP: p.IP, Live: false, Time: p.SentTime, Alert: true})
+	}
+}
+
+//Take removes and returns the host changes since the last call
+func (t *SweepTracker) Take() []*SweepResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	results := make([]*SweepResult, 0)
+	for _, s := range t.sweeps {
+		if len(s.changes) == 0 {
+			continue
+		}
+		results = append(results, &SweepResult{Device: s.device, Changes: s.changes})
+		s.changes = nil
+	}
+	return results
+}
+
+//Remove stops tracking the Device with the given id
+func (t *SweepTracker) Remove(id string) {
+	t.mu.Lock()
+	delete(t.sweeps, id)
+	t.mu.Unlock()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandSubnet(t *testing.T) {
+	tests := []struct {
+		cidr string
+		max  int
+		want string
+		err  bool
+	}{
+		{"192.0.2.0/30", 10, "192.0.2.1 192.0.2.2", false},
+		{"192.0.2.4/31", 10, "192.0.2.4 192.0.2.5", false},
+		{"192.0.2.5/32", 10, "192.0.2.5", false},
+		//host bits are ignored
+		{"192.0.2.7/29", 10, "192.0.2.1 192.0.2.2 192.0.2.3 192.0.2.4 192.0.2.5 192.0.2.6", false},
+		{"192.0.2.254/31", 10, "192.0.2.254 192.0.2.255", false},
+		//IPv6 subnets have no broadcast address
+		{"2001:db8::/126", 10, "2001:db8:: 2001:db8::1 2001:db8::2 2001:db8::3", false},
+		{"2001:db8::4/127", 10, "2001:db8::4 2001:db8::5", false},
+		{"2001:db8::1/128", 10, "2001:db8::1", false},
+		{"2001:db8:0:1::/126", 10, "2001:db8:0:1:: 2001:db8:0:1::1 2001:db8:0:1::2 2001:db8:0:1::3", false},
+		{"192.0.2.0/30", 2, "192.0.2.1 192.0.2.2", false},
+		{"192.0.2.0/30", 1, "", true},
+		{"192.0.2.0/24", 254, "", false},
+		{"192.0.2.0/24", 253, "", true},
+		{"2001:db8::/126", 3, "", true},
+		{"10.0.0.0/8", 1000, "", true},
+		{"2001:db8::/64", 1 << 30, "", true},
+		{"192.0.2.1", 10, "", true},
+	}
+
+	for _, test := range tests {
+		ips, err := expandSubnet(test.cidr, test.max)
+		if (err != nil) != test.err {
+			t.Errorf("%s, %d: err = %v, want error: %v", test.cidr, test.max, err, test.err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		if len(ips) > test.max {
+			t.Errorf("%s, %d: %d addresses, want at most %d", test.cidr, test.max, len(ips), test.max)
+		}
+		if test.want == "" {
+			continue
+		}
+		strs := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			strs = append(strs, ip.String())
+		}
+		if got := strings.Join(strs, " "); got != test.want {
+			t.Errorf("%s, %d = %s, want %s", test.cidr, test.max, got, test.want)
+		}
+	}
+}
+
+//changeString formats c as ip live|down, with an alert suffix
+func changeString(c *HostChange) string {
+	s := c.IP.String() + " down"
+	if c.Live {
+		s = c.IP.String() + " live"
+	}
+	if c.Alert {
+		s += " alert"
+	}
+	return s
+}
+
+func TestSweepTrackerUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies []bool
+		want    []string
+	}{
+		//the first observation only records the initial state
+		{"initial live", []bool{true}, []string{"192.0.2.1 live"}},
+		{"initial down", []bool{false}, []string{"192.0.2.1 down"}},
+		{"below miss threshold", []bool{true, false}, []string{"192.0.2.1 live"}},
+		{"miss threshold", []bool{true, false, false}, []string{"192.0.2.1 live", "192.0.2.1 down alert"}},
+		{"misses reset by reply", []bool{true, false, true, false}, []string{"192.0.2.1 live"}},
+		{"reappearance", []bool{true, false, false, false, true}, []string{"192.0.2.1 live", "192.0.2.1 down alert", "192.0.2.1 live alert"}},
+		{"appearance", []bool{false, false, true}, []string{"192.0.2.1 down", "192.0.2.1 live alert"}},
+		{"still live", []bool{true, true, true}, []string{"192.0.2.1 live"}},
+	}
+
+	for _, test := range tests {
+		tr := NewSweepTracker(2)
+		d := testDevice("1", "subnet")
+		for i, reply := range test.replies {
+			p := &Ping{Device: d, IP: net.ParseIP("192.0.2.1"), SentTime: time.Unix(int64(i), 0), Sent: 1}
+			if reply {
+				p.Received = 1
+			}
+			tr.Update(p)
+		}
+
+		results := tr.Take()
+		if len(results) != 1 || results[0].Device != d {
+			t.Errorf("%s: %d results, want 1 for the Device", test.name, len(results))
+			continue
+		}
+		got := make([]string, 0)
+		for _, c := range results[0].Changes {
+			got = append(got, changeString(c))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: changes = %v, want %v", test.name, got, test.want)
+		}
+
+		//changes are only returned once
+		if results = tr.Take(); len(results) != 0 {
+			t.Errorf("%s: %d results after Take, want none", test.name, len(results))
+		}
+	}
+}
+
+func TestSweepTrackerDevices(t *testing.T) {
+	tr := NewSweepTracker(1)
+	a, b := testDevice("a", "a"), testDevice("b", "b")
+
+	//the same address in different sweeps is tracked separately
+	ip := net.ParseIP("192.0.2.1")
+	tr.Update(&Ping{Device: a, IP: ip, Sent: 1, Received: 1})
+	tr.Update(&Ping{Device: b, IP: ip, Sent: 1})
+	if results := tr.Take(); len(results) != 2 {
+		t.Fatalf("%d results, want 2", len(results))
+	}
+
+	tr.Update(&Ping{Device: a, IP: ip, Sent: 1})
+	tr.Remove("b")
+	tr.Update(&Ping{Device: b, IP: ip, Sent: 1})
+
+	changes := make(map[string]string)
+	for _, r := range tr.Take() {
+		for _, c := range r.Changes {
+			changes[r.Device.ID] = changeString(c)
+		}
+	}
+	//b is new again after it's removed
+	if changes["a"] != "192.0.2.1 down alert" || changes["b"] != "192.0.2.1 down" {
+		t.Errorf("changes = %v", changes)
+	}
+}
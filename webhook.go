@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//WebhookFormat is the payload format of a webhook
+type WebhookFormat string
+
+//Supported webhook formats
+const (
+	WebhookJSON  WebhookFormat = "json"
+	WebhookSlack WebhookFormat = "slack"
+	WebhookTeams WebhookFormat = "teams"
+)
+
+//WebhookNotifier is a Notifier that POSTs Alerts to a URL
+type WebhookNotifier struct {
+	url    string
+	format WebhookFormat
+	client *http.Client
+}
+
+//NewWebhookNotifier returns a new WebhookNotifier from a spec in the form "format:url", e.g.
+//"slack:https://hooks.slack.com/services/...". If format is omitted, json is used
+func NewWebhookNotifier(spec string) (*WebhookNotifier, error) {
+	format, url := WebhookJSON, spec
+	if i := strings.Index(spec, ":"); i > 0 {
+		switch f := WebhookFormat(spec[:i]); f {
+		case WebhookJSON, WebhookSlack, WebhookTeams:
+			format, url = f, spec[i+1:]
+		}
+	}
+
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("Invalid webhook URL: %s", url)
+	}
+
+	return &WebhookNotifier{url: url, format: format, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (w *WebhookNotifier) Name() string {
+	return fmt.Sprintf("webhook (%s)", w.format)
+}
+
+//color returns a hex color for the Alert
+func color(a *Alert) string {
+	switch a.Kind {
+	case AlertDown:
+		return "D32F2F"
+	case AlertRecovered:
+		return "388E3C"
+	case AlertUnreachable:
+		return "757575"
+	}
+	return "FBC02D"
+}
+
+//payload returns the webhook body for a
+func (w *WebhookNotifier) payload(a *Alert) interface{} {
+	switch w.format {
+	case WebhookSlack:
+		return map[string]interface{}{
+			"text": a.Message,
+			"attachments": []map[string]interface{}{{
+				"color":    "#" + color(a),
+				"fallback": a.Message,
+				"fields": []map[string]interface{}{
+					{"title": "Hostname", "value": a.Device.Hostname, "short": true},
+					{"title": "Alert", "value": string(a.Kind), "short": true},
+				},
+				"ts": a.Time.Unix(),
+			}},
+		}
+	case WebhookTeams:
+		return map[string]interface{}{
+			"@type":      "MessageCard",
+			"@context":   "http://schema.org/extensions",
+			"summary":    a.Message,
+			"themeColor": color(a),
+			"title":      a.Device.Hostname,
+			"text":       a.Message,
+		}
+	}
+
+	type alert struct {
+		Kind          AlertKind `json:"kind"`
+		DeviceID      string    `json:"device_id"`
+		Hostname      string    `json:"hostname"`
+		IP            *string   `json:"ip"`
+		Time          time.Time `json:"time"`
+		PreviousState State     `json:"previous_state,omitempty"`
+		State         State     `json:"state,omitempty"`
+		Flapping      bool      `json:"flapping"`
+		Loss          float64   `json:"loss_pct"`
+		RTT           float64   `json:"rtt"`
+		Appeared      []string  `json:"appeared,omitempty"`
+		Disappeared   []string  `json:"disappeared,omitempty"`
+		Message       string    `json:"message"`
+	}
+
+	p := &alert{
+		Kind:          a.Kind,
+		DeviceID:      a.Device.ID,
+		Hostname:      a.Device.Hostname,
+		Time:          a.Time.UTC(),
+		PreviousState: a.PreviousState,
+		State:         a.State,
+		Flapping:      a.Flapping,
+		Loss:          a.Loss,
+		RTT:           float64(a.AvgRTT) / float64(time.Millisecond),
+		Message:       a.Message,
+	}
+	if a.IP != nil {
+		ip := a.IP.String()
+		p.IP = &ip
+	}
+	for _, ip := range a.Appeared {
+		p.Appeared = append(p.Appeared, ip.String())
+	}
+	for _, ip := range a.Disappeared {
+		p.Disappeared = append(p.Disappeared, ip.String())
+	}
+	return p
+}
+
+func (w *WebhookNotifier) Notify(a *Alert) error {
+	body, err := json.Marshal(w.payload(a))
+	if err != nil {
+		return fmt.Errorf("Unable to marshal payload: %v", err)
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Unable to POST webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected status: %s", resp.Status)
+	}
+
+	return nil
+}
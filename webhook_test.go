@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+//webhookServer records the bodies POSTed to it. The first fail requests get a 503
+type webhookServer struct {
+	*httptest.Server
+	bodies chan map[string]interface{}
+	times  chan time.Time
+
+	fail int
+	mu   *sync.Mutex
+}
+
+func newWebhookServer(t *testing.T, fail int) *webhookServer {
+	s := &webhookServer{bodies: make(chan map[string]interface{}, 100), times: make(chan time.Time, 100), fail: fail, mu: new(sync.Mutex)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.times <- time.Now()
+
+		s.mu.Lock()
+		fail := s.fail > 0
+		s.fail--
+		s.mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", ct)
+		}
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Unable to read body: %v", err)
+		}
+		body := make(map[string]interface{})
+		if err = json.Unmarshal(buf, &body); err != nil {
+			t.Errorf("Unable to unmarshal body: %v", err)
+		}
+		s.bodies <- body
+	}))
+	return s
+}
+
+//next returns the next body received, failing the test if none is received within a few seconds
+func (s *webhookServer) next(t *testing.T) map[string]interface{} {
+	t.Helper()
+	select {
+	case b := <-s.bodies:
+		return b
+	case <-time.After(5 * time.Second):
+		t.Fatal("No webhook received")
+		return nil
+	}
+}
+
+func testDevice(id, hostname string) *Device {
+	return &Device{ID: id, Hostname: hostname, ips: make([]net.IP, 0), mu: new(sync.RWMutex)}
+}
+
+func TestWebhookPayload(t *testing.T) {
+	s := newWebhookServer(t, 0)
+	defer s.Close()
+
+	a := &Alert{
+		Kind:          AlertDown,
+		Device:        testDevice("1", "router"),
+		Time:          time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		PreviousState: StateUp,
+		State:         StateDown,
+		Message:       "router is down",
+	}
+
+	tests := []struct {
+		format string
+		want   map[string]interface{}
+	}{
+		{"", map[string]interface{}{
+			"kind": "down", "device_id": "1", "hostname": "router", "ip": nil, "time": "2020-01-02T03:04:05Z",
+			"previous_state": "up", "state": "down", "flapping": false, "message": "router is down",
+		}},
+		{"json", map[string]interface{}{"kind": "down", "hostname": "router", "message": "router is down"}},
+		{"slack", map[string]interface{}{"text": "router is down"}},
+		{"teams", map[string]interface{}{
+			"@type": "MessageCard", "summary": "router is down", "themeColor": "D32F2F", "title": "router", "text": "router is down",
+		}},
+	}
+
+	for _, test := range tests {
+		spec := s.URL
+		if test.format != "" {
+			spec = test.format + ":" + s.URL
+		}
+		w, err := NewWebhookNotifier(spec)
+		if err != nil {
+			t.Fatalf("%s: Unable to create WebhookNotifier: %v", spec, err)
+		}
+		if err = w.Notify(a); err != nil {
+			t.Fatalf("%s: Unable to notify: %v", spec, err)
+		}
+
+		body := s.next(t)
+		for k, v := range test.want {
+			if body[k] != v {
+				t.Errorf("%s: %s = %#v, want %#v", spec, k, body[k], v)
+			}
+		}
+
+		if test.format == "slack" {
+			attachments, _ := body["attachments"].([]interface{})
+			if len(attachments) != 1 {
+				t.Fatalf("%s: attachments = %#v, want 1", spec, body["attachments"])
+			}
+			att := attachments[0].(map[string]interface{})
+			if att["color"] != "#D32F2F" || att["ts"] != float64(a.Time.Unix()) {
+				t.Errorf("%s: attachment = %#v", spec, att)
+			}
+			fields, _ := att["fields"].([]interface{})
+			if len(fields) != 2 || fields[0].(map[string]interface{})["value"] != "router" {
+				t.Errorf("%s: fields = %#v", spec, att["fields"])
+			}
+		}
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	s := newWebhookServer(t, 2)
+	defer s.Close()
+
+	w, err := NewWebhookNotifier(s.URL)
+	if err != nil {
+		t.Fatalf("Unable to create WebhookNotifier: %v", err)
+	}
+	n, err := NewNotifyService([]Notifier{w}, &AlertThresholds{}, "", time.Hour, 2, 10, false)
+	if err != nil {
+		t.Fatalf("Unable to create NotifyService: %v", err)
+	}
+
+	n.HandleEvent(&Event{Device: testDevice("1", "router"), Time: time.Now(), PreviousState: StateUp, State: StateDown})
+	if body := s.next(t); body["kind"] != "down" {
+		t.Errorf("kind = %v, want down", body["kind"])
+	}
+
+	//two 503s, then success, with the backoff doubling between attempts
+	times := make([]time.Time, 3)
+	for i := range times {
+		times[i] = <-s.times
+	}
+	if d := times[1].Sub(times[0]); d < time.Second {
+		t.Errorf("first retry after %v, want at least 1s", d)
+	}
+	if d := times[2].Sub(times[1]); d < 2*time.Second {
+		t.Errorf("second retry after %v, want at least 2s", d)
+	}
+}
+
+func TestWebhookDedup(t *testing.T) {
+	s := newWebhookServer(t, 0)
+	defer s.Close()
+
+	w, err := NewWebhookNotifier(s.URL)
+	if err != nil {
+		t.Fatalf("Unable to create WebhookNotifier: %v", err)
+	}
+	n, err := NewNotifyService([]Notifier{w}, &AlertThresholds{}, "", time.Hour, 0, 10, false)
+	if err != nil {
+		t.Fatalf("Unable to create NotifyService: %v", err)
+	}
+
+	d := testDevice("1", "router")
+	now := time.Now()
+	event := func(prev, state State) *Event {
+		now = now.Add(time.Minute)
+		return &Event{Device: d, Time: now, PreviousState: prev, State: state}
+	}
+
+	events := []*Event{
+		//a Device that was only degraded doesn't send a recovery
+		event(StateUnknown, StateUp),
+		event(StateUp, StateDegraded),
+		event(StateDegraded, StateUp),
+		//alerted once per dedup window
+		event(StateUp, StateDown),
+		event(StateDegraded, StateDown),
+		//an outage ending through degraded still recovers once
+		event(StateDown, StateDegraded),
+		event(StateDegraded, StateUp),
+		event(StateUp, StateDegraded),
+		event(StateDegraded, StateUp),
+		//down again within the dedup window of the last down Alert, but after a recovery
+		event(StateUp, StateDown),
+	}
+	for _, e := range events {
+		n.HandleEvent(e)
+	}
+	//other Devices are deduplicated separately
+	n.HandleEvent(&Event{Device: testDevice("2", "switch"), Time: now, PreviousState: StateUp, State: StateDown})
+
+	want := []string{"1/down", "1/recovered", "1/down", "2/down"}
+	for _, k := range want {
+		body := s.next(t)
+		if got := body["device_id"].(string) + "/" + body["kind"].(string); got != k {
+			t.Errorf("alert = %s, want %s", got, k)
+		}
+	}
+}